@@ -0,0 +1,398 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	no_route     = -1
+	unassigned   = -1
+	stage_assign = "assign"
+)
+
+// Costs holds the fastest allowed commute in seconds from every person to
+// every office of the workbook, no_route when there is none.
+type Costs struct {
+	Seconds [][]int
+	Modes   [][]string
+}
+
+// buildCosts reads the durations of the workbook into a cost matrix.
+// Driving only counts for persons who can drive.
+func (m *Map) buildCosts() (*Costs, error) {
+	durations := []PairDuration{}
+	err := m.durations().Find(m.ctx, m.workbookFilter()).Select(bson.M{"person_id": 1, "office_id": 1, "mode": 1, "seconds": 1}).All(&durations)
+	if err != nil {
+		return nil, err
+	}
+	personIndex := make(map[string]int, len(m.personSlice))
+	for i, p := range m.personSlice {
+		personIndex[p.Id.Hex()] = i
+	}
+	officeIndex := make(map[string]int, len(m.officeSlice))
+	for j, o := range m.officeSlice {
+		officeIndex[o.Id.Hex()] = j
+	}
+	c := &Costs{
+		Seconds: make([][]int, len(m.personSlice)),
+		Modes:   make([][]string, len(m.personSlice)),
+	}
+	for i := range c.Seconds {
+		c.Seconds[i] = make([]int, len(m.officeSlice))
+		c.Modes[i] = make([]string, len(m.officeSlice))
+		for j := range c.Seconds[i] {
+			c.Seconds[i][j] = no_route
+		}
+	}
+	for _, d := range durations {
+		i, ok := personIndex[d.PersonId.Hex()]
+		if !ok {
+			continue
+		}
+		j, ok := officeIndex[d.OfficeId.Hex()]
+		if !ok {
+			continue
+		}
+		if d.Mode == "drive" && !m.personSlice[i].CanDrive {
+			continue
+		}
+		if c.Seconds[i][j] == no_route || d.Seconds < c.Seconds[i][j] {
+			c.Seconds[i][j] = d.Seconds
+			c.Modes[i][j] = d.Mode
+		}
+	}
+	return c, nil
+}
+
+// rank returns the position of office j in the ranking of person i,
+// starting at 1, or 0 without a route.
+func (c *Costs) rank(i, j int) int {
+	if c.Seconds[i][j] == no_route {
+		return 0
+	}
+	r := 1
+	for k, s := range c.Seconds[i] {
+		if s != no_route && (s < c.Seconds[i][j] || (s == c.Seconds[i][j] && k < j)) {
+			r++
+		}
+	}
+	return r
+}
+
+// capacities returns the capacity of every office, offices without one
+// take everybody.
+func (m *Map) capacities() []int {
+	r := make([]int, len(m.officeSlice))
+	for j, o := range m.officeSlice {
+		r[j] = o.Capacity
+		if r[j] <= 0 {
+			r[j] = len(m.personSlice)
+		}
+	}
+	return r
+}
+
+// flowEdge is an edge of the residual graph of a min-cost flow.
+type flowEdge struct {
+	to, rev   int
+	cap, cost int
+}
+
+type flowGraph struct {
+	edges [][]flowEdge
+}
+
+func newFlowGraph(n int) *flowGraph {
+	return &flowGraph{edges: make([][]flowEdge, n)}
+}
+
+func (g *flowGraph) add(from, to, cap, cost int) {
+	g.edges[from] = append(g.edges[from], flowEdge{to: to, rev: len(g.edges[to]), cap: cap, cost: cost})
+	g.edges[to] = append(g.edges[to], flowEdge{to: from, rev: len(g.edges[from]) - 1, cap: 0, cost: -cost})
+}
+
+// nodeQueue is the priority queue of Dijkstra, closest node first.
+type nodeQueue []nodeDist
+
+type nodeDist struct {
+	node, dist int
+}
+
+func (q nodeQueue) Len() int            { return len(q) }
+func (q nodeQueue) Less(a, b int) bool  { return q[a].dist < q[b].dist }
+func (q nodeQueue) Swap(a, b int)       { q[a], q[b] = q[b], q[a] }
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(nodeDist)) }
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	x := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return x
+}
+
+// minCostFlow sends as much flow as possible from s to t at the least cost.
+// Dijkstra with potentials finds the shortest distances in O(E log V), then
+// blocking flows are pushed along every shortest path at once, as in Dinic,
+// until t can only be reached by a longer path. Costs must not be negative.
+func (g *flowGraph) minCostFlow(s, t int) (int, int) {
+	n := len(g.edges)
+	potential := make([]int, n)
+	dist := make([]int, n)
+	level := make([]int, n)
+	next := make([]int, n)
+	flow, cost := 0, 0
+	for {
+		for v := range dist {
+			dist[v] = -1
+		}
+		dist[s] = 0
+		queue := &nodeQueue{{node: s}}
+		for queue.Len() > 0 {
+			top := heap.Pop(queue).(nodeDist)
+			u := top.node
+			if top.dist > dist[u] {
+				continue // stale entry
+			}
+			for _, e := range g.edges[u] {
+				if e.cap <= 0 {
+					continue
+				}
+				d := dist[u] + e.cost + potential[u] - potential[e.to]
+				if dist[e.to] < 0 || d < dist[e.to] {
+					dist[e.to] = d
+					heap.Push(queue, nodeDist{node: e.to, dist: d})
+				}
+			}
+		}
+		if dist[t] < 0 {
+			return flow, cost
+		}
+		// nodes out of reach stay so, only edges of shortest paths change
+		for v := 0; v < n; v++ {
+			if dist[v] >= 0 {
+				potential[v] += dist[v]
+			}
+		}
+		for g.levels(s, t, level, potential) {
+			for v := range next {
+				next[v] = 0
+			}
+			for {
+				push := g.augment(s, t, -1, level, next, potential)
+				if push == 0 {
+					break
+				}
+				flow += push
+				cost += push * (potential[t] - potential[s])
+			}
+		}
+	}
+}
+
+// tight tells if e is on a shortest path, its reduced cost is 0.
+func tight(e flowEdge, from int, potential []int) bool {
+	return e.cap > 0 && e.cost+potential[from]-potential[e.to] == 0
+}
+
+// levels numbers the nodes by their distance from s along tight edges, and
+// tells if t can be reached.
+func (g *flowGraph) levels(s, t int, level, potential []int) bool {
+	for v := range level {
+		level[v] = -1
+	}
+	level[s] = 0
+	queue := []int{s}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for _, e := range g.edges[u] {
+			if level[e.to] < 0 && tight(e, u, potential) {
+				level[e.to] = level[u] + 1
+				queue = append(queue, e.to)
+			}
+		}
+	}
+	return level[t] >= 0
+}
+
+// augment pushes up to limit, -1 for no limit, from u to t along tight
+// edges going one level up, and returns what it pushed.
+func (g *flowGraph) augment(u, t, limit int, level, next, potential []int) int {
+	if u == t {
+		return limit
+	}
+	for ; next[u] < len(g.edges[u]); next[u]++ {
+		e := &g.edges[u][next[u]]
+		if level[e.to] != level[u]+1 || !tight(*e, u, potential) {
+			continue
+		}
+		push := e.cap
+		if limit >= 0 && limit < push {
+			push = limit
+		}
+		if push = g.augment(e.to, t, push, level, next, potential); push > 0 {
+			e.cap -= push
+			g.edges[e.to][e.rev].cap += push
+			return push
+		}
+	}
+	return 0
+}
+
+// flowNetwork is the graph of persons to offices used by the solvers.
+func flowNetwork(seconds [][]int, capacity []int, allowed func(i, j int) bool, cost func(s int) int) (*flowGraph, int, int) {
+	persons, offices := len(seconds), len(capacity)
+	source, sink := persons+offices, persons+offices+1
+	g := newFlowGraph(persons + offices + 2)
+	for i := 0; i < persons; i++ {
+		g.add(source, i, 1, 0)
+		for j := 0; j < offices; j++ {
+			if seconds[i][j] == no_route || (allowed != nil && !allowed(i, j)) {
+				continue
+			}
+			g.add(i, persons+j, 1, cost(seconds[i][j]))
+		}
+	}
+	for j := 0; j < offices; j++ {
+		g.add(persons+j, sink, capacity[j], 0)
+	}
+	return g, source, sink
+}
+
+// countAssignable returns how many persons can be assigned at most, a
+// max flow without costs.
+func countAssignable(seconds [][]int, capacity []int, allowed func(i, j int) bool) int {
+	g, source, sink := flowNetwork(seconds, capacity, allowed, func(int) int { return 0 })
+	flow, _ := g.minCostFlow(source, sink)
+	return flow
+}
+
+// solveMinCost assigns every person to at most one office, respecting the
+// capacities, so that as many persons as possible are assigned with the
+// least total commute. allowed may forbid pairs, nil allows every routed
+// pair. It returns the office of every person, or unassigned.
+func solveMinCost(seconds [][]int, capacity []int, allowed func(i, j int) bool) []int {
+	persons, offices := len(seconds), len(capacity)
+	g, source, sink := flowNetwork(seconds, capacity, allowed, func(s int) int { return s })
+	g.minCostFlow(source, sink)
+	r := make([]int, persons)
+	for i := range r {
+		r[i] = unassigned
+		for _, e := range g.edges[i] {
+			if e.to >= persons && e.to < persons+offices && e.cap == 0 && e.cost >= 0 {
+				r[i] = e.to - persons
+			}
+		}
+	}
+	return r
+}
+
+// assignOffices assigns persons to offices within their capacities under
+// the configured objective, the least total commute by default, and keeps
+// the assigned office and its rank in the person's own ranking. With
+// -compare every objective is solved to compare them.
+func (m *Map) assignOffices() error {
+	if !containsString(objectives, m.cfg.Objective) {
+		return fmt.Errorf("unknown objective: %v", m.cfg.Objective)
+	}
+	if m.cfg.Objective == objective_capped && m.cfg.CapMinutes <= 0 {
+		return fmt.Errorf("objective %v needs -cap-minutes", objective_capped)
+	}
+	m.log.Infof("Assign persons to offices, objective: %v", m.cfg.Objective)
+	costs, err := m.buildCosts()
+	if err != nil {
+		return err
+	}
+	capacity := m.capacities()
+	m.preferences = m.loadPreferences(costs)
+	m.constraints = m.loadConstraints()
+	assigned, infeasible := m.solveObjective(m.cfg.Objective, costs, capacity)
+	m.objectiveStats = []ObjectiveStats{objectiveStats(m.objectiveName(m.cfg.Objective), costs, assigned)}
+	if m.cfg.Compare {
+		m.objectiveStats = m.compareObjectives(costs, capacity, assigned)
+	}
+	printObjectives(m.objectiveStats)
+	if m.run != nil {
+		m.run.Objectives = m.objectiveStats
+	}
+	m.applyAssignment(costs, assigned)
+	if m.constraints != nil {
+		m.reportConstraints(infeasible)
+		if m.run != nil {
+			m.run.Infeasible = infeasible
+		}
+	}
+	if m.cfg.Objective == objective_stable || m.preferences.stated() {
+		report := m.reportMatching(m.preferences, assigned, capacity)
+		if m.run != nil {
+			m.run.Matching = &report
+		}
+	}
+	return nil
+}
+
+// applyAssignment keeps an assignment on the persons and offices.
+func (m *Map) applyAssignment(costs *Costs, assigned []int) {
+	for j := range m.officeSlice {
+		m.officeSlice[j].Assigned = 0
+	}
+	left, total := 0, 0
+	for i := range m.personSlice {
+		p := &m.personSlice[i]
+		j := assigned[i]
+		if j == unassigned {
+			p.AssignedOffice, p.AssignedRank, p.AssignedMinutes = "", 0, 0
+			left++
+			continue
+		}
+		p.AssignedOffice = m.officeSlice[j].Name
+		p.AssignedRank = costs.rank(i, j)
+		p.AssignedMinutes = costs.Seconds[i][j] / 60
+		if costs.Seconds[i][j] == no_route {
+			p.AssignedMinutes = 0
+		}
+		m.officeSlice[j].Assigned++
+		total += p.AssignedMinutes
+	}
+	m.log.Infof("Assigned %d persons, %d minutes in total, %d persons left without office", len(m.personSlice)-left, total, left)
+}
+
+// readCapacity parses the capacity cell at index of a row, an empty cell
+// means no limit. Anything but a headcount is an error.
+func readCapacity(row []string, index int) (int, error) {
+	if len(row) <= index {
+		return 0, nil
+	}
+	cell := strings.TrimSpace(row[index])
+	if cell == "" {
+		return 0, nil
+	}
+	capacity, err := strconv.Atoi(cell)
+	if err != nil || capacity < 0 {
+		return 0, fmt.Errorf("%q is not a headcount", cell)
+	}
+	return capacity, nil
+}
+
+// fillAssignment writes the assigned office of every person and its rank
+// next to the person's ranking.
+func (m *Map) fillAssignment() {
+	office := string(rune(sheet_person_assigned_col))
+	rank := string(rune(sheet_person_assigned_col + 1))
+	m.excelFile.SetCellStr(sheet_person, office+"1", "assigned office")
+	m.excelFile.SetCellStr(sheet_person, rank+"1", "rank")
+	for index, p := range m.personSlice {
+		row := strconv.Itoa(index + 2)
+		if p.AssignedOffice == "" {
+			m.excelFile.SetCellStr(sheet_person, office+row, "")
+			m.excelFile.SetCellStr(sheet_person, rank+row, "")
+			continue
+		}
+		m.excelFile.SetCellStr(sheet_person, office+row, fmt.Sprintf("%v (%d)", p.AssignedOffice, p.AssignedMinutes))
+		m.excelFile.SetCellInt(sheet_person, rank+row, p.AssignedRank)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// longest returns the longest commute of an assignment in minutes and how
+// many persons have it.
+func longest(seconds [][]int, assigned []int) (int, int) {
+	max, n := 0, 0
+	for i, j := range assigned {
+		if j == unassigned {
+			continue
+		}
+		switch m := seconds[i][j] / 60; {
+		case m > max:
+			max, n = m, 1
+		case m == max:
+			n++
+		}
+	}
+	return max, n
+}
+
+func TestSolveMinCost(t *testing.T) {
+	tests := []struct {
+		name     string
+		seconds  [][]int
+		capacity []int
+		want     []int
+	}{
+		{"nearest", [][]int{{10, 100}, {20, 30}}, []int{1, 1}, []int{0, 1}},
+		{"capacity", [][]int{{10, 20}, {10, 50}}, []int{1, 1}, []int{1, 0}},
+		{"more persons first", [][]int{{10, no_route}, {5, 100}}, []int{1, 1}, []int{0, 1}},
+		{"no route", [][]int{{no_route, 10}, {no_route, 20}}, []int{2, 1}, []int{1, unassigned}},
+		{"no capacity", [][]int{{10}, {20}}, []int{0}, []int{unassigned, unassigned}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := solveMinCost(tt.seconds, tt.capacity, nil); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("solveMinCost() = %v, want %v", got, tt.want)
+			}
+			if got, want := countAssignable(tt.seconds, tt.capacity, nil), countAssigned(tt.want); got != want {
+				t.Errorf("countAssignable() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestSolveMinCostAllowed(t *testing.T) {
+	seconds := [][]int{{10, 100}, {20, 30}}
+	got := solveMinCost(seconds, []int{1, 1}, func(i, j int) bool { return !(i == 0 && j == 0) })
+	if want := []int{1, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("solveMinCost() = %v, want %v", got, want)
+	}
+}
+
+func TestSolveBottleneck(t *testing.T) {
+	tests := []struct {
+		name      string
+		seconds   [][]int
+		capacity  []int
+		want      []int
+		wantLimit int
+	}{
+		{"longest over total", [][]int{{0, 60}, {60, 100}}, []int{1, 1}, []int{1, 0}, 60},
+		{"least total within the limit", [][]int{{10, 50}, {20, 50}, {50, 50}}, []int{2, 1}, []int{0, 0, 1}, 50},
+		{"no route", [][]int{{no_route, 600}, {no_route, 1200}}, []int{1, 1}, []int{1, unassigned}, 600},
+		{"no capacity", [][]int{{10}, {20}}, []int{0}, []int{unassigned, unassigned}, no_route},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, limit := solveBottleneck(tt.seconds, tt.capacity, nil)
+			if !reflect.DeepEqual(got, tt.want) || limit != tt.wantLimit {
+				t.Errorf("solveBottleneck() = %v, %v, want %v, %v", got, limit, tt.want, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestSolveMinMax(t *testing.T) {
+	tests := []struct {
+		name     string
+		seconds  [][]int
+		capacity []int
+		wantMax  int // minutes
+		wantAt   int // persons at wantMax
+		wantN    int // persons assigned
+	}{
+		{"longest over total", [][]int{{0, 3600}, {3600, 6000}}, []int{1, 1}, 60, 2, 2},
+		{"fewest at the longest", [][]int{{600, 1200}, {600, 1200}, {300, 1200}}, []int{2, 2}, 20, 1, 3},
+		{"minutes", [][]int{{600, 659}, {659, 600}}, []int{1, 1}, 10, 2, 2},
+		{"no route", [][]int{{no_route, 600}, {no_route, 1200}}, []int{1, 1}, 10, 1, 1},
+		{"no capacity", [][]int{{10}, {20}}, []int{0}, 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := solveMinMax(tt.seconds, tt.capacity, nil)
+			max, at := longest(tt.seconds, got)
+			if max != tt.wantMax || at != tt.wantAt || countAssigned(got) != tt.wantN {
+				t.Errorf("solveMinMax() = %v, longest %v by %v of %v, want %v by %v of %v",
+					got, max, at, countAssigned(got), tt.wantMax, tt.wantAt, tt.wantN)
+			}
+		})
+	}
+}
+
+// rebalanced plans moves from the current offices and returns where the
+// persons end up.
+func rebalanced(seconds [][]int, current, capacity []int, worst bool, saving, moves int) []int {
+	r := &rebalancer{
+		seconds: seconds,
+		current: append([]int{}, current...),
+		left:    append([]int{}, capacity...),
+		movable: make([]bool, len(seconds)),
+		apart:   make([][]int, len(seconds)),
+		worst:   worst,
+		saving:  saving,
+		moves:   moves,
+	}
+	for i, j := range current {
+		r.left[j]--
+		r.movable[i] = true
+	}
+	for r.moves > 0 {
+		if _, _, ok := r.step(); !ok {
+			break
+		}
+	}
+	return r.current
+}
+
+func TestRebalance(t *testing.T) {
+	tests := []struct {
+		name     string
+		seconds  [][]int
+		current  []int
+		capacity []int
+		worst    bool
+		saving   int
+		moves    int
+		want     []int
+	}{
+		{"move", [][]int{{1000, 400}}, []int{0}, []int{1, 1}, false, 300, 10, []int{1}},
+		{"below the saving", [][]int{{1000, 800}}, []int{0}, []int{1, 1}, false, 300, 10, []int{0}},
+		{"move cap", [][]int{{1000, 400}, {1000, 100}}, []int{0, 0}, []int{2, 2}, false, 300, 1, []int{0, 1}},
+		{"swap", [][]int{{1000, 100}, {100, 1000}}, []int{0, 1}, []int{1, 1}, false, 300, 2, []int{1, 0}},
+		{"swap over the move cap", [][]int{{1000, 100}, {100, 1000}}, []int{0, 1}, []int{1, 1}, false, 300, 1, []int{0, 1}},
+		{"no room", [][]int{{1000, 100}, {1000, 100}}, []int{0, 1}, []int{1, 1}, false, 300, 10, []int{0, 1}},
+		{"no route", [][]int{{1000, no_route}}, []int{0}, []int{1, 1}, false, 300, 10, []int{0}},
+		{"longest", [][]int{{1000, 700}, {600, 500}}, []int{0, 0}, []int{2, 1}, true, 0, 1, []int{1, 0}},
+		{"longest of all persons", [][]int{{1000, 900}, {600, 100}}, []int{0, 0}, []int{2, 1}, true, 0, 1, []int{1, 0}},
+		{"nobody at the longest can move", [][]int{{1000, 1000}, {600, 100}}, []int{0, 0}, []int{2, 1}, true, 0, 10, []int{0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rebalanced(tt.seconds, tt.current, tt.capacity, tt.worst, tt.saving, tt.moves)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("rebalance = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCapacity(t *testing.T) {
+	// an office row with its results, as an older version wrote it
+	row := func(capacity ...string) []string {
+		r := []string{"east", "road 1"}
+		for i := 0; i < nearest_persons; i++ {
+			r = append(r, "li (20)")
+		}
+		return append(r, capacity...)
+	}
+	tests := []struct {
+		name    string
+		row     []string
+		want    int
+		wantErr bool
+	}{
+		{"number", row("3"), 3, false},
+		{"empty", row(" "), 0, false},
+		{"missing", row(), 0, false},
+		{"no results", []string{"east", "road 1"}, 0, false},
+		{"negative", row("-1"), 0, true},
+		{"not a number", row("many"), 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readCapacity(tt.row, sheet_office_capacity_index)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("readCapacity() = %v, %v, want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Config holds the tunables of a pipeline run. It is saved on every run
+// document so results can be traced back to the settings that produced them.
+type Config struct {
+	ExcelFile  string   `bson:"excel_file" json:"excel_file"`
+	Region     string   `bson:"region" json:"region"`
+	DepartAt   string   `bson:"depart_at" json:"depart_at"`
+	Modes      []string `bson:"modes" json:"modes"`
+	Workers    int      `bson:"workers" json:"workers"`
+	QPS        int      `bson:"qps" json:"qps"` // calls per second allowed for the api key
+	MongoURL   string   `bson:"mongo_url" json:"mongo_url"`
+	Database   string   `bson:"database" json:"database"`
+	Collection string   `bson:"collection" json:"collection"`
+	// BulkSize is the number of updates sent in one BulkWrite.
+	BulkSize     int  `bson:"bulk_size" json:"bulk_size"`
+	BulkOrdered  bool `bson:"bulk_ordered" json:"bulk_ordered"`
+	WriteRetries int  `bson:"write_retries" json:"write_retries"`
+	// Lease is how long a claimed job stays reserved for its process.
+	Lease       time.Duration `bson:"lease" json:"lease"`
+	MaxAttempts int           `bson:"max_attempts" json:"max_attempts"`
+	// Batch is the number of routes a worker claims at once.
+	Batch int           `bson:"batch" json:"batch"`
+	Poll  time.Duration `bson:"poll" json:"poll"`
+	Idle  time.Duration `bson:"idle" json:"idle"`
+	// The api key is never saved.
+	AK string `bson:"-" json:"-"`
+	SK string `bson:"-" json:"-"`
+	// Grace is how long in-flight calls may run after a shutdown signal.
+	Grace   time.Duration `bson:"grace" json:"grace"`
+	Partial bool          `bson:"partial" json:"partial"`
+	// MaxDistanceKm skips routing pairs further apart as the crow flies,
+	// 0 routes every pair.
+	MaxDistanceKm float64 `bson:"max_distance_km" json:"max_distance_km"`
+	// Quota is the number of api calls allowed per day for the key.
+	Quota  int  `bson:"quota" json:"quota"`
+	DryRun bool `bson:"-" json:"-"`
+	// MetricsAddr serves /metrics when set, PushGateway receives the
+	// metrics when the command finishes.
+	MetricsAddr string `bson:"metrics_addr" json:"metrics_addr"`
+	PushGateway string `bson:"pushgateway" json:"pushgateway"`
+	LogFormat   string `bson:"log_format" json:"log_format"`
+	LogLevel    string `bson:"log_level" json:"log_level"`
+	LogFile     string `bson:"log_file" json:"log_file"`
+	// Listen and DataDir are used by the serve command, uploaded workbooks
+	// and their results are kept under DataDir.
+	Listen  string `bson:"listen" json:"listen"`
+	DataDir string `bson:"data_dir" json:"data_dir"`
+	// Token is required from clients of the serve command, as a bearer
+	// token or a token parameter.
+	Token string `bson:"-" json:"-"`
+	// MapAK is a browser key of the baidu map javascript api, used by the
+	// dashboard of the serve command.
+	MapAK string `bson:"-" json:"-"`
+	// Assign runs the assignment stage after the rankings.
+	Assign     bool   `bson:"assign" json:"assign"`
+	Objective  string `bson:"objective" json:"objective"`
+	CapMinutes int    `bson:"cap_minutes" json:"cap_minutes"` // no commute above it for the capped objective
+	Compare    bool   `bson:"compare" json:"compare"`         // solves every objective to compare them
+	// Reach reports the persons reaching every office within the thresholds.
+	Reach bool `bson:"reach" json:"reach"`
+	// Rebalance plans moves from the current office column of the persons.
+	Rebalance bool `bson:"rebalance" json:"rebalance"`
+	MaxMoves  int  `bson:"max_moves" json:"max_moves"`
+	MinSaving int  `bson:"min_saving" json:"min_saving"` // minutes per person moved
+	// K sites are chosen by the sites command for the Location objective,
+	// next to the offices in Keep. The suggest command makes K clusters and
+	// searches PlaceQuery within Radius metres of them.
+	K          int    `bson:"k" json:"k"`
+	Location   string `bson:"location" json:"location"`
+	Keep       string `bson:"keep" json:"keep"`
+	Cluster    string `bson:"cluster" json:"cluster"`
+	Radius     int    `bson:"radius" json:"radius"`
+	PlaceQuery string `bson:"place_query" json:"place_query"`
+	// Thresholds are the minutes of the isochrones, sampled on Rings rings
+	// of Bearings points around an office.
+	Thresholds string `bson:"thresholds" json:"thresholds"`
+	Bearings   int    `bson:"bearings" json:"bearings"`
+	Rings      int    `bson:"rings" json:"rings"`
+	// Within and Save are used by the query command.
+	Within int  `bson:"-" json:"-"`
+	Save   bool `bson:"-" json:"-"`
+}
+
+type modesFlag struct {
+	modes *[]string
+}
+
+func (f modesFlag) String() string {
+	if f.modes == nil {
+		return ""
+	}
+	return strings.Join(*f.modes, ",")
+}
+
+func (f modesFlag) Set(s string) error {
+	*f.modes = []string{}
+	for _, mode := range strings.Split(s, ",") {
+		mode = strings.TrimSpace(mode)
+		if mode == "" {
+			continue
+		}
+		if _, ok := path_map[mode]; !ok {
+			return fmt.Errorf("unknown mode: %v", mode)
+		}
+		*f.modes = append(*f.modes, mode)
+	}
+	return nil
+}
+
+// newConfig registers the common flags on fs and returns the config they
+// fill in. The defaults are the values the tool has always used.
+func newConfig(fs *flag.FlagSet) *Config {
+	cfg := &Config{
+		Modes: append([]string{}, path_type...),
+	}
+	fs.StringVar(&cfg.ExcelFile, "excel", execel_file, "workbook with the persons and offices sheets")
+	fs.StringVar(&cfg.Region, "region", default_region, "region used for geocoding")
+	fs.StringVar(&cfg.DepartAt, "depart-at", time_morning, "departure time used for routing ("+time_format+")")
+	fs.Var(modesFlag{&cfg.Modes}, "modes", "comma separated travel modes (walk,ride,transport,drive)")
+	fs.IntVar(&cfg.Workers, "workers", max_workers, "number of concurrent geocoding and routing workers")
+	fs.IntVar(&cfg.QPS, "qps", default_qps, "maximum number of baidu api calls per second, 0 for no limit")
+	fs.StringVar(&cfg.MongoURL, "mongo", mongo_url, "mongodb url")
+	fs.StringVar(&cfg.Database, "database", mongo_database, "mongodb database")
+	fs.StringVar(&cfg.Collection, "collection", mongo_collection, "mongodb collection for persons and offices")
+	fs.IntVar(&cfg.BulkSize, "bulk-size", bulk_size, "number of updates sent to mongodb in one bulk write")
+	fs.BoolVar(&cfg.BulkOrdered, "bulk-ordered", false, "stop a bulk write at the first failing update")
+	fs.IntVar(&cfg.WriteRetries, "write-retries", write_retries, "retries of a bulk write on transient errors")
+	fs.DurationVar(&cfg.Lease, "lease", lease_duration, "how long a claimed route stays reserved before another run may take it")
+	fs.IntVar(&cfg.MaxAttempts, "max-attempts", max_attempts, "attempts of a failing route before it is given up")
+	fs.IntVar(&cfg.Batch, "batch", batch_size, "number of routes claimed at once")
+	fs.DurationVar(&cfg.Poll, "poll", poll_interval, "how often to look for routes of other workers")
+	fs.DurationVar(&cfg.Idle, "idle", idle_timeout, "a worker exits after being idle for this long")
+	fs.StringVar(&cfg.AK, "ak", myak, "baidu api key")
+	fs.StringVar(&cfg.SK, "sk", sk, "baidu secret key used to sign requests")
+	fs.DurationVar(&cfg.Grace, "grace", grace_period, "how long in-flight calls may finish after SIGINT/SIGTERM")
+	fs.BoolVar(&cfg.Partial, "partial", false, "write a workbook marked as incomplete when interrupted")
+	fs.Float64Var(&cfg.MaxDistanceKm, "max-distance", 0, "do not route a person to offices further than this many km as the crow flies, 0 for no limit")
+	fs.IntVar(&cfg.Quota, "quota", daily_quota, "baidu api calls allowed per day")
+	fs.BoolVar(&cfg.DryRun, "dry-run", false, "only estimate the calls, quota and time of the run, same as the plan command")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", "", "address to serve prometheus metrics on, e.g. :9100")
+	fs.StringVar(&cfg.PushGateway, "pushgateway", "", "pushgateway url the metrics are pushed to when the command finishes")
+	fs.StringVar(&cfg.LogFormat, "log-format", log_format_text, "log format, text or json")
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "log level: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFile, "log-file", "", "file the log is appended to instead of stderr")
+	fs.StringVar(&cfg.Listen, "listen", default_listen, "address the serve command listens on")
+	fs.StringVar(&cfg.Token, "token", "", "token clients of the serve command must send, required unless it listens on a loopback address")
+	fs.StringVar(&cfg.DataDir, "data-dir", default_data_dir, "directory for the workbooks uploaded to the serve command")
+	fs.StringVar(&cfg.MapAK, "map-ak", "", "browser key of the baidu map javascript api for the dashboard")
+	fs.IntVar(&cfg.Within, "within", 0, "query: only list offices reachable within this many minutes, 0 for all")
+	fs.BoolVar(&cfg.Save, "save", false, "query: keep the geocoded address in the cache")
+	fs.BoolVar(&cfg.Assign, "assign", false, "assign persons to offices within the capacity column W of the offices sheet, after the results")
+	fs.StringVar(&cfg.Objective, "objective", objective_total, "assignment objective: total, bottleneck, minmax, capped or stable, stable reads the seniority in column Q and preferred offices from column R of the persons sheet")
+	fs.IntVar(&cfg.CapMinutes, "cap-minutes", 0, "longest commute in minutes allowed by the capped objective")
+	fs.BoolVar(&cfg.Compare, "compare", false, "assign: also solve every other objective and compare them, slow for large workbooks")
+	fs.BoolVar(&cfg.Reach, "reach", false, "report who reaches every office within 15, 30, 45 and 60 minutes by every mode")
+	fs.BoolVar(&cfg.Rebalance, "rebalance", false, "plan moves and swaps from the current office column of the persons sheet, reducing the longest commute with -objective bottleneck or minmax")
+	fs.IntVar(&cfg.MaxMoves, "max-moves", default_max_moves, "most persons moved by the rebalancing plan")
+	fs.IntVar(&cfg.MinSaving, "min-saving", default_saving, "least minutes saved per person moved by the rebalancing plan")
+	fs.IntVar(&cfg.K, "k", 1, "sites: number of candidate sites to choose, suggest: number of clusters")
+	fs.StringVar(&cfg.Location, "location", location_median, "sites: median for the least total commute, center for the least longest one")
+	fs.StringVar(&cfg.Keep, "keep", "", "sites: comma separated offices of the workbook kept open, all for every office")
+	fs.StringVar(&cfg.Cluster, "cluster", cluster_kmedoids, "suggest: kmeans or kmedoids")
+	fs.IntVar(&cfg.Radius, "radius", default_radius, "suggest: metres searched around the median of a cluster")
+	fs.StringVar(&cfg.PlaceQuery, "place-query", default_place_query, "suggest: places searched as sites")
+	fs.StringVar(&cfg.Thresholds, "thresholds", "30,45", "isochrones: comma separated minutes")
+	fs.IntVar(&cfg.Bearings, "bearings", default_bearings, "isochrones: directions sampled around an office")
+	fs.IntVar(&cfg.Rings, "rings", default_rings, "isochrones: distances sampled in every direction")
+	return cfg
+}
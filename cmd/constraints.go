@@ -0,0 +1,433 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	sheet_pinned     = "pinned"     // person, office
+	sheet_together   = "together"   // persons who share an office, one group per row
+	sheet_apart      = "apart"      // two persons who must not share an office
+	sheet_infeasible = "infeasible" // constraints the assignment could not honour
+	group_steps      = 100000       // placements tried for the groups before giving up
+)
+
+// Constraints are hard constraints of the assignment, by index into the
+// workbook slices.
+type Constraints struct {
+	Pins   map[int]int
+	Groups [][]int
+	Apart  [][2]int
+	names  func(persons []int) string
+	office func(j int) string
+	// conflicts are found reading the sheets
+	conflicts []string
+}
+
+// readRows reads the rows of an optional sheet below its header, trimmed
+// and without empty cells.
+func (m *Map) readRows(sheet string) [][]string {
+	r := [][]string{}
+	for _, row := range m.readColumns(sheet) {
+		cells := []string{}
+		for _, cell := range row {
+			if cell != "" {
+				cells = append(cells, cell)
+			}
+		}
+		r = append(r, cells)
+	}
+	return r
+}
+
+// readColumns reads the rows of an optional sheet below its header, trimmed
+// and with every cell in its column. Empty rows are left out.
+func (m *Map) readColumns(sheet string) [][]string {
+	r := [][]string{}
+	if m.excelFile.GetSheetIndex(sheet) < 0 {
+		return r
+	}
+	rows, err := m.excelFile.GetRows(sheet)
+	if err != nil {
+		m.log.Errorf("Reading %v fails, err: %v", sheet, err)
+		return r
+	}
+	for index, row := range rows {
+		if index == 0 {
+			continue
+		}
+		empty := true
+		for k := range row {
+			row[k] = strings.TrimSpace(row[k])
+			empty = empty && row[k] == ""
+		}
+		if !empty {
+			r = append(r, row)
+		}
+	}
+	return r
+}
+
+// loadConstraints reads the pinned, together and apart sheets of the
+// workbook, nil when it has none. Groups sharing a person are merged.
+func (m *Map) loadConstraints() *Constraints {
+	personIndex := make(map[string]int, len(m.personSlice))
+	for i, p := range m.personSlice {
+		personIndex[p.Name] = i
+	}
+	officeIndex := make(map[string]int, len(m.officeSlice))
+	for j, o := range m.officeSlice {
+		officeIndex[o.Name] = j
+	}
+	persons := func(sheet string, row []string) []int {
+		r := []int{}
+		for _, name := range row {
+			i, ok := personIndex[name]
+			if !ok {
+				m.log.Warnf("Unknown person %v in %v", name, sheet)
+				continue
+			}
+			r = append(r, i)
+		}
+		return r
+	}
+	c := &Constraints{
+		Pins: map[int]int{},
+		names: func(persons []int) string {
+			names := []string{}
+			for _, i := range persons {
+				names = append(names, m.personSlice[i].Name)
+			}
+			return strings.Join(names, ", ")
+		},
+		office: func(j int) string { return m.officeSlice[j].Name },
+	}
+	for _, row := range m.readRows(sheet_pinned) {
+		p := persons(sheet_pinned, row[:1])
+		if len(p) == 0 {
+			continue
+		}
+		if len(row) < 2 {
+			m.log.Warnf("No office for %v in %v", row[0], sheet_pinned)
+			continue
+		}
+		j, ok := officeIndex[row[1]]
+		if !ok {
+			m.log.Warnf("Unknown office %v in %v", row[1], sheet_pinned)
+			continue
+		}
+		if k, ok := c.Pins[p[0]]; ok && k != j {
+			c.conflicts = append(c.conflicts, fmt.Sprintf("%v pinned to both %v and %v", row[0], m.officeSlice[k].Name, row[1]))
+		}
+		c.Pins[p[0]] = j
+	}
+
+	// merge the groups sharing a person
+	parent := make([]int, len(m.personSlice))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	grouped := map[int]bool{}
+	for _, row := range m.readRows(sheet_together) {
+		group := persons(sheet_together, row)
+		for _, i := range group {
+			grouped[i] = true
+			parent[find(i)] = find(group[0])
+		}
+	}
+	members := map[int][]int{}
+	for i := range m.personSlice {
+		if grouped[i] {
+			members[find(i)] = append(members[find(i)], i)
+		}
+	}
+	for _, group := range members {
+		if len(group) > 1 {
+			c.Groups = append(c.Groups, group)
+		}
+	}
+	sort.Slice(c.Groups, func(a, b int) bool { return c.Groups[a][0] < c.Groups[b][0] })
+
+	for _, row := range m.readRows(sheet_apart) {
+		pair := persons(sheet_apart, row)
+		if len(pair) != 2 {
+			m.log.Warnf("%v needs two persons per row: %v", sheet_apart, strings.Join(row, ", "))
+			continue
+		}
+		c.Apart = append(c.Apart, [2]int{pair[0], pair[1]})
+	}
+	if len(c.Pins) == 0 && len(c.Groups) == 0 && len(c.Apart) == 0 {
+		return nil
+	}
+	m.log.Infof("Constraints: %d pinned, %d groups, %d apart pairs", len(c.Pins), len(c.Groups), len(c.Apart))
+	return c
+}
+
+// solve assigns persons with solve within the constraints. Pinned persons
+// and groups are placed first, the groups by a search over the offices in
+// order of their total commute, then solve assigns the others and apart
+// pairs sharing an office are repaired by forbidding one of them that
+// office. Constraints that can not be honoured are returned with the
+// conflicts of the sheets and the assignment goes on without them.
+func (c *Constraints) solve(costs *Costs, capacity []int, solve func(capacity []int, allowed func(i, j int) bool) []int) ([]int, []string) {
+	persons, offices := len(costs.Seconds), len(capacity)
+	infeasible := append([]string{}, c.conflicts...)
+	fixed := make([]int, persons)
+	for i := range fixed {
+		fixed[i] = unassigned
+	}
+	left := append([]int{}, capacity...)
+	apart := make([][]int, persons)
+	for _, pair := range c.Apart {
+		apart[pair[0]] = append(apart[pair[0]], pair[1])
+		apart[pair[1]] = append(apart[pair[1]], pair[0])
+	}
+	// fits tells if persons can share office j with the persons placed
+	fits := func(group []int, j int) bool {
+		if left[j] < len(group) {
+			return false
+		}
+		for _, i := range group {
+			for _, k := range apart[i] {
+				if fixed[k] == j {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	pinned := make([]int, 0, len(c.Pins))
+	for i := range c.Pins {
+		pinned = append(pinned, i)
+	}
+	sort.Ints(pinned)
+	for _, i := range pinned {
+		j := c.Pins[i]
+		if !fits([]int{i}, j) {
+			infeasible = append(infeasible, fmt.Sprintf("%v pinned to %v: over capacity or with a person to keep apart", c.names([]int{i}), c.office(j)))
+			continue
+		}
+		fixed[i] = j
+		left[j]--
+	}
+
+	// groups with a pinned member go to its office
+	free := [][]int{}
+	for _, group := range c.Groups {
+		inside := false
+		for a := range group {
+			for b := a + 1; b < len(group); b++ {
+				for _, k := range apart[group[a]] {
+					if k == group[b] {
+						inside = true
+					}
+				}
+			}
+		}
+		if inside {
+			infeasible = append(infeasible, fmt.Sprintf("group %v holds persons to keep apart", c.names(group)))
+			continue
+		}
+		offices := map[int]bool{}
+		rest := []int{}
+		for _, i := range group {
+			if fixed[i] != unassigned {
+				offices[fixed[i]] = true
+			} else {
+				rest = append(rest, i)
+			}
+		}
+		switch len(offices) {
+		case 0:
+			free = append(free, group)
+		case 1:
+			for j := range offices {
+				if !fits(rest, j) {
+					infeasible = append(infeasible, fmt.Sprintf("group %v does not fit at %v where a member is pinned", c.names(group), c.office(j)))
+					continue
+				}
+				for _, i := range rest {
+					fixed[i] = j
+				}
+				left[j] -= len(rest)
+			}
+		default:
+			infeasible = append(infeasible, fmt.Sprintf("group %v is pinned to different offices", c.names(group)))
+		}
+	}
+
+	// the other groups, largest first, each over the offices they can all
+	// reach by their total commute
+	sort.SliceStable(free, func(a, b int) bool { return len(free[a]) > len(free[b]) })
+	candidates := make([][]int, len(free))
+	for g, group := range free {
+		total := make([]int, offices)
+		for j := 0; j < offices; j++ {
+			for _, i := range group {
+				if costs.Seconds[i][j] == no_route {
+					total[j] = no_route
+					break
+				}
+				total[j] += costs.Seconds[i][j]
+			}
+			if total[j] != no_route {
+				candidates[g] = append(candidates[g], j)
+			}
+		}
+		sort.SliceStable(candidates[g], func(a, b int) bool { return total[candidates[g][a]] < total[candidates[g][b]] })
+	}
+	place := func(group []int, j int) {
+		for _, i := range group {
+			fixed[i] = j
+		}
+		left[j] -= len(group)
+	}
+	unplace := func(group []int, j int) {
+		for _, i := range group {
+			fixed[i] = unassigned
+		}
+		left[j] += len(group)
+	}
+	steps := 0
+	var search func(g int) bool
+	search = func(g int) bool {
+		if g == len(free) {
+			return true
+		}
+		for _, j := range candidates[g] {
+			if steps++; steps > group_steps {
+				return false
+			}
+			if !fits(free[g], j) {
+				continue
+			}
+			place(free[g], j)
+			if search(g + 1) {
+				return true
+			}
+			unplace(free[g], j)
+		}
+		return false
+	}
+	if !search(0) {
+		// place what fits one by one and report the others
+		for g, group := range free {
+			placed := false
+			for _, j := range candidates[g] {
+				if fits(group, j) {
+					place(group, j)
+					placed = true
+					break
+				}
+			}
+			if !placed {
+				infeasible = append(infeasible, fmt.Sprintf("group %v does not fit in any office it can reach", c.names(group)))
+			}
+		}
+	}
+
+	forbidden := map[[2]int]bool{}
+	allowed := func(i, j int) bool {
+		if fixed[i] != unassigned || forbidden[[2]int{i, j}] {
+			return false
+		}
+		for _, k := range apart[i] {
+			if fixed[k] == j {
+				return false
+			}
+		}
+		return true
+	}
+	merge := func(assigned []int) []int {
+		for i, j := range fixed {
+			if j != unassigned {
+				assigned[i] = j
+			}
+		}
+		return assigned
+	}
+	// better prefers more persons assigned, then the shorter total commute
+	better := func(a, b []int) bool {
+		if na, nb := countAssigned(a), countAssigned(b); na != nb {
+			return na > nb
+		}
+		ta, tb := 0, 0
+		for i := range a {
+			if a[i] != unassigned && costs.Seconds[i][a[i]] != no_route {
+				ta += costs.Seconds[i][a[i]]
+			}
+			if b[i] != unassigned && costs.Seconds[i][b[i]] != no_route {
+				tb += costs.Seconds[i][b[i]]
+			}
+		}
+		return ta < tb
+	}
+	assigned := merge(solve(left, allowed))
+	for round := 0; round <= len(c.Apart)*offices; round++ {
+		violated := -1
+		for k, pair := range c.Apart {
+			if assigned[pair[0]] != unassigned && assigned[pair[0]] == assigned[pair[1]] {
+				violated = k
+				break
+			}
+		}
+		if violated < 0 {
+			break
+		}
+		pair, j := c.Apart[violated], assigned[c.Apart[violated][0]]
+		var best []int
+		var bestKey [2]int
+		for _, i := range pair {
+			key := [2]int{i, j}
+			if fixed[i] != unassigned || forbidden[key] {
+				continue
+			}
+			forbidden[key] = true
+			try := merge(solve(left, allowed))
+			delete(forbidden, key)
+			if best == nil || better(try, best) {
+				best, bestKey = try, key
+			}
+		}
+		if best == nil {
+			break
+		}
+		forbidden[bestKey] = true
+		assigned = best
+	}
+	for _, pair := range c.Apart {
+		if j := assigned[pair[0]]; j != unassigned && j == assigned[pair[1]] {
+			infeasible = append(infeasible, fmt.Sprintf("%v are both at %v", c.names(pair[:]), c.office(j)))
+		}
+	}
+	return assigned, infeasible
+}
+
+// reportConstraints prints the constraints that could not be honoured and
+// writes them to their own sheet.
+func (m *Map) reportConstraints(infeasible []string) {
+	m.excelFile.DeleteSheet(sheet_infeasible)
+	if len(infeasible) == 0 {
+		fmt.Fprintf(os.Stdout, "all constraints honoured\n")
+		return
+	}
+	m.excelFile.NewSheet(sheet_infeasible)
+	m.excelFile.SetCellStr(sheet_infeasible, "A1", "infeasible constraint")
+	for k, s := range infeasible {
+		m.log.Warnf("Infeasible constraint: %v", s)
+		fmt.Fprintf(os.Stdout, "infeasible: %v\n", s)
+		m.excelFile.SetCellStr(sheet_infeasible, "A"+strconv.Itoa(k+2), s)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestConstraintsSolve(t *testing.T) {
+	tests := []struct {
+		name           string
+		seconds        [][]int
+		capacity       []int
+		pins           map[int]int
+		groups         [][]int
+		apart          [][2]int
+		want           []int
+		wantInfeasible int
+	}{
+		{"pinned", [][]int{{10, 100}, {20, 30}}, []int{1, 1}, map[int]int{0: 1}, nil, nil, []int{1, 0}, 0},
+		{"pinned over capacity", [][]int{{10, 100}, {20, 30}}, []int{1, 1}, map[int]int{0: 0, 1: 0}, nil, nil, []int{0, 1}, 1},
+		{"group", [][]int{{10, 100}, {100, 20}}, []int{2, 2}, nil, [][]int{{0, 1}}, nil, []int{0, 0}, 0},
+		{"group with a pinned member", [][]int{{10, 100}, {100, 20}}, []int{2, 2}, map[int]int{1: 1}, [][]int{{0, 1}}, nil, []int{1, 1}, 0},
+		{"group without room", [][]int{{10, 100}, {100, 20}}, []int{1, 1}, nil, [][]int{{0, 1}}, nil, []int{0, 1}, 1},
+		{"group without a route", [][]int{{10, no_route}, {no_route, 20}}, []int{2, 2}, nil, [][]int{{0, 1}}, nil, []int{0, 1}, 1},
+		{"apart", [][]int{{10, 100}, {10, 30}}, []int{2, 2}, nil, nil, [][2]int{{0, 1}}, []int{0, 1}, 0},
+		{"apart in a group", [][]int{{10, 100}, {10, 30}}, []int{2, 2}, nil, [][]int{{0, 1}}, [][2]int{{0, 1}}, []int{0, 1}, 1},
+		{"apart without room", [][]int{{10}, {10}}, []int{2}, nil, nil, [][2]int{{0, 1}}, []int{unassigned, 0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Constraints{
+				Pins:   tt.pins,
+				Groups: tt.groups,
+				Apart:  tt.apart,
+				names:  func(persons []int) string { return fmt.Sprint(persons) },
+				office: func(j int) string { return fmt.Sprint(j) },
+			}
+			if c.Pins == nil {
+				c.Pins = map[int]int{}
+			}
+			got, infeasible := c.solve(&Costs{Seconds: tt.seconds}, tt.capacity, func(capacity []int, allowed func(i, j int) bool) []int {
+				return solveMinCost(tt.seconds, capacity, allowed)
+			})
+			if !reflect.DeepEqual(got, tt.want) || len(infeasible) != tt.wantInfeasible {
+				t.Errorf("solve() = %v, infeasible %q, want %v with %d infeasible", got, infeasible, tt.want, tt.wantInfeasible)
+			}
+		})
+	}
+}
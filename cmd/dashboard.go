@@ -0,0 +1,188 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+type dashboardRun struct {
+	Id        primitive.ObjectID `json:"id"`
+	StartedAt string             `json:"started_at"`
+	Workbook  string             `json:"workbook"`
+}
+
+type dashboardPerson struct {
+	Id      primitive.ObjectID `json:"id"` // of the snapshot
+	Name    string             `json:"name"`
+	Address string             `json:"address"`
+	Poi     Poi                `json:"poi"`
+	Office  string             `json:"office"`  // top office
+	Minutes int                `json:"minutes"` // commute to the top office
+}
+
+type dashboardOffice struct {
+	Id      primitive.ObjectID `json:"id"` // of the snapshot
+	Name    string             `json:"name"`
+	Address string             `json:"address"`
+	Poi     Poi                `json:"poi"`
+	Persons int                `json:"persons"`
+	Median  int                `json:"median"` // median commute of its ranked persons
+}
+
+type dashboardRank struct {
+	Name    string         `json:"name"`
+	Mode    string         `json:"mode"`
+	Minutes int            `json:"minutes"`
+	Modes   map[string]int `json:"modes,omitempty"` // minutes per mode
+}
+
+type dashboardDetail struct {
+	Name    string          `json:"name"`
+	Address string          `json:"address"`
+	Ranking []dashboardRank `json:"ranking"`
+}
+
+// registerDashboard serves the page of the map of persons and offices on
+// mux and its data on api, which needs the token.
+func (s *service) registerDashboard(mux, api *http.ServeMux) {
+	web, _ := fs.Sub(webFiles, "web")
+	mux.Handle("/", http.FileServer(http.FS(web)))
+	api.HandleFunc("/api/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"map_ak": s.m.cfg.MapAK})
+	})
+	api.HandleFunc("/api/runs", s.handleRuns)
+	api.HandleFunc("/api/map", s.handleMap)
+	api.HandleFunc("/api/person", s.handlePerson)
+	api.HandleFunc("/api/office", s.handleOffice)
+}
+
+// handleRuns lists the finished runs that can be shown.
+func (s *service) handleRuns(w http.ResponseWriter, r *http.Request) {
+	runs := []Run{}
+	err := s.m.mongoCli.Database.Collection(mongo_collection_runs).Find(r.Context(), bson.M{"status": run_status_done}).Sort("-started_at").Limit(service_job_list).All(&runs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	r2 := make([]dashboardRun, 0, len(runs))
+	for _, run := range runs {
+		r2 = append(r2, dashboardRun{Id: run.Id, StartedAt: run.StartedAt.Format(time_format), Workbook: run.Config.ExcelFile})
+	}
+	writeJSON(w, http.StatusOK, r2)
+}
+
+// dashboardSnapshot loads the rankings of the run given by the run
+// parameter, the latest finished run by default.
+func (s *service) dashboardSnapshot(r *http.Request) ([]PersonSnapshot, []OfficeSnapshot, error) {
+	runId, err := primitive.ObjectIDFromHex(r.URL.Query().Get("run"))
+	if err != nil {
+		run := Run{}
+		err := s.m.mongoCli.Database.Collection(mongo_collection_runs).Find(r.Context(), bson.M{"status": run_status_done}).Sort("-started_at").One(&run)
+		if err != nil {
+			return nil, nil, fmt.Errorf("No finished run")
+		}
+		runId = run.Id
+	}
+	return s.m.loadSnapshot(runId)
+}
+
+// handleMap returns every person and office of a run with its poi and the
+// commute that colours its marker.
+func (s *service) handleMap(w http.ResponseWriter, r *http.Request) {
+	persons, offices, err := s.dashboardSnapshot(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	r2 := struct {
+		Persons []dashboardPerson `json:"persons"`
+		Offices []dashboardOffice `json:"offices"`
+	}{[]dashboardPerson{}, []dashboardOffice{}}
+	for _, p := range persons {
+		dp := dashboardPerson{Id: p.Id, Name: p.Name, Address: p.Address, Poi: p.Poi, Minutes: -1}
+		if len(p.NearestOffices) > 0 && p.NearestOffices[0] != "" {
+			dp.Office, dp.Minutes = p.NearestOffices[0], p.NearestDurations[0]
+		}
+		r2.Persons = append(r2.Persons, dp)
+	}
+	for _, o := range offices {
+		do := dashboardOffice{Id: o.Id, Name: o.Name, Address: o.Address, Poi: o.Poi, Persons: len(o.SortList), Median: -1}
+		if len(o.SortList) > 0 {
+			minutes := make([]int, 0, len(o.SortList))
+			for _, d := range o.SortList {
+				minutes = append(minutes, d.Duration)
+			}
+			sort.Ints(minutes)
+			do.Median = minutes[len(minutes)/2]
+		}
+		r2.Offices = append(r2.Offices, do)
+	}
+	writeJSON(w, http.StatusOK, r2)
+}
+
+// handlePerson returns the top offices of a person, given by the id of its
+// snapshot, with the minutes of every mode when the run was made.
+func (s *service) handlePerson(w http.ResponseWriter, r *http.Request) {
+	persons, _, err := s.dashboardSnapshot(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	for _, p := range persons {
+		if p.Id.Hex() != id {
+			continue
+		}
+		d := dashboardDetail{Name: p.Name, Address: p.Address, Ranking: []dashboardRank{}}
+		for i, office := range p.NearestOffices {
+			if office == "" {
+				break
+			}
+			rank := dashboardRank{Name: office, Minutes: p.NearestDurations[i]}
+			if i < len(p.NearestModes) {
+				rank.Modes = p.NearestModes[i]
+			}
+			for mode, minutes := range rank.Modes {
+				if minutes == rank.Minutes && (rank.Mode == "" || mode < rank.Mode) {
+					rank.Mode = mode
+				}
+			}
+			d.Ranking = append(d.Ranking, rank)
+		}
+		writeJSON(w, http.StatusOK, d)
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("no such person"))
+}
+
+// handleOffice returns the ranked persons of an office, given by the id of
+// its snapshot.
+func (s *service) handleOffice(w http.ResponseWriter, r *http.Request) {
+	_, offices, err := s.dashboardSnapshot(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	for _, o := range offices {
+		if o.Id.Hex() != id {
+			continue
+		}
+		d := dashboardDetail{Name: o.Name, Address: o.Address, Ranking: []dashboardRank{}}
+		for _, p := range o.SortList {
+			d.Ranking = append(d.Ranking, dashboardRank{Name: p.PersonName, Mode: p.Path, Minutes: p.Duration})
+		}
+		writeJSON(w, http.StatusOK, d)
+		return
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("no such office"))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// PairDuration is the route result from a person to an office by one mode.
+// It is the only place where pairwise results are stored; rankings of
+// persons and offices are computed from it.
+type PairDuration struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	PersonId   primitive.ObjectID `bson:"person_id"`
+	OfficeId   primitive.ObjectID `bson:"office_id"`
+	Mode       string             `bson:"mode"`
+	DepartAt   string             `bson:"depart_at,omitempty"`
+	Seconds    int                `bson:"seconds"`
+	Metres     int                `bson:"metres"`
+	ComputedAt time.Time          `bson:"computed_at"`
+}
+
+// RankedPair is one row of a ranking: the office of a person or the person
+// of an office, with the fastest allowed mode.
+type RankedPair struct {
+	Id      primitive.ObjectID `bson:"_id"`
+	Mode    string             `bson:"mode"`
+	Seconds int                `bson:"seconds"`
+}
+
+func (m *Map) durations() *qmgo.Collection {
+	return m.mongoCli.Database.Collection(mongo_collection_durations)
+}
+
+func (m *Map) ensureDurationIndexes() error {
+	return m.durations().EnsureIndexes(m.ctx, []string{"person_id,office_id,mode"}, []string{"office_id"})
+}
+
+func pairFilter(personId, officeId primitive.ObjectID, mode string) bson.M {
+	return bson.M{"person_id": personId, "office_id": officeId, "mode": mode}
+}
+
+func (m *Map) saveDuration(d PairDuration) error {
+	return m.durationWriter.Upsert(m.ctx, pairFilter(d.PersonId, d.OfficeId, d.Mode), d)
+}
+
+func (m *Map) removeDurations(filter bson.M) error {
+	_, err := m.durations().RemoveAll(m.ctx, filter)
+	return err
+}
+
+// personModes returns the modes that count for a person's ranking.
+func (m *Map) personModes(canDrive bool) []string {
+	r := []string{}
+	for _, mode := range m.cfg.Modes {
+		if !canDrive && mode == "drive" {
+			continue
+		}
+		r = append(r, mode)
+	}
+	return r
+}
+
+// fastestPipeline keeps the fastest mode per counterpart and sorts the
+// counterparts by that duration. groupBy is "$office_id" or "$person_id".
+func fastestPipeline(match bson.M, groupBy string, limit int) []bson.M {
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$sort": bson.D{{Key: "seconds", Value: 1}}},
+		{"$group": bson.M{
+			"_id":     groupBy,
+			"mode":    bson.M{"$first": "$mode"},
+			"seconds": bson.M{"$first": "$seconds"},
+		}},
+		{"$sort": bson.D{{Key: "seconds", Value: 1}, {Key: "_id", Value: 1}}},
+	}
+	if limit > 0 {
+		pipeline = append(pipeline, bson.M{"$limit": limit})
+	}
+	return pipeline
+}
+
+// loadedIds returns the ids of the loaded persons and offices. Rankings are
+// restricted to them, the store also holds routes of other workbooks,
+// scenarios and jobs, and of entities since removed from the workbook.
+func (m *Map) loadedIds() ([]primitive.ObjectID, []primitive.ObjectID) {
+	personIds := make([]primitive.ObjectID, 0, len(m.personSlice))
+	for _, p := range m.personSlice {
+		personIds = append(personIds, p.Id)
+	}
+	officeIds := make([]primitive.ObjectID, 0, len(m.officeSlice))
+	for _, o := range m.officeSlice {
+		officeIds = append(officeIds, o.Id)
+	}
+	return personIds, officeIds
+}
+
+// rankOffices returns the nearest offices of a person among the loaded
+// ones.
+func (m *Map) rankOffices(person *Person, limit int) ([]RankedPair, error) {
+	_, officeIds := m.loadedIds()
+	match := bson.M{
+		"person_id": person.Id,
+		"office_id": bson.M{"$in": officeIds},
+		"mode":      bson.M{"$in": m.personModes(person.CanDrive)},
+	}
+	r := []RankedPair{}
+	err := m.durations().Aggregate(m.ctx, fastestPipeline(match, "$office_id", limit)).All(&r)
+	return r, err
+}
+
+// rankPersons returns the nearest persons of an office among the loaded
+// ones. Driving only counts for persons who can drive.
+func (m *Map) rankPersons(office *Office, limit int) ([]RankedPair, error) {
+	personIds, _ := m.loadedIds()
+	drivers := []primitive.ObjectID{}
+	for _, p := range m.personSlice {
+		if p.CanDrive {
+			drivers = append(drivers, p.Id)
+		}
+	}
+	match := bson.M{
+		"office_id": office.Id,
+		"person_id": bson.M{"$in": personIds},
+		"$or": []bson.M{
+			{"mode": bson.M{"$in": m.personModes(false)}},
+			{"mode": "drive", "person_id": bson.M{"$in": drivers}},
+		},
+	}
+	if !containsString(m.cfg.Modes, "drive") {
+		match = bson.M{
+			"office_id": office.Id,
+			"person_id": bson.M{"$in": personIds},
+			"mode":      bson.M{"$in": m.cfg.Modes},
+		}
+	}
+	r := []RankedPair{}
+	err := m.durations().Aggregate(m.ctx, fastestPipeline(match, "$person_id", limit)).All(&r)
+	return r, err
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
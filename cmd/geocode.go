@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Geocode caches the POI of a normalised address so that every distinct
+// address is only geocoded once, across runs and imports.
+type Geocode struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	Region     string             `bson:"region"`
+	Address    string             `bson:"address"` // normalised address
+	Raw        string             `bson:"raw"`     // address as it was geocoded
+	Poi        Poi                `bson:"poi"`
+	ComputedAt time.Time          `bson:"computed_at"`
+}
+
+type geocodeResult struct {
+	address string
+	poi     Poi
+	err     error
+}
+
+// normalizeAddress folds full-width characters, drops white space and
+// lower-cases latin letters, so "上海市 浦东新区１号" and "上海市浦东新区1号"
+// are the same address.
+func normalizeAddress(addr string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '　' || unicode.IsSpace(r) {
+			return -1
+		}
+		if r >= '！' && r <= '～' {
+			r = r - '！' + '!'
+		}
+		return unicode.ToLower(r)
+	}, addr)
+}
+
+func isZeroPoi(poi Poi) bool {
+	return IsEqual(poi.Lat, 0) && IsEqual(poi.Lng, 0)
+}
+
+func (m *Map) geocodes() *qmgo.Collection {
+	return m.mongoCli.Database.Collection(mongo_collection_geocodes)
+}
+
+// cachedPois returns the cached POI of the given normalised addresses.
+func (m *Map) cachedPois(addresses []string) (map[string]Poi, error) {
+	cached := []Geocode{}
+	err := m.geocodes().Find(m.ctx, bson.M{"region": m.cfg.Region, "address": bson.M{"$in": addresses}}).All(&cached)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]Poi, len(cached))
+	for _, g := range cached {
+		r[g.Address] = g.Poi
+	}
+	return r, nil
+}
+
+// geocodeAll geocodes the distinct addresses missing from the cache through
+// the worker pool and caches the results. raw maps a normalised address to
+// the address sent to the server.
+func (m *Map) geocodeAll(raw map[string]string) (map[string]Poi, error) {
+	addresses := make([]string, 0, len(raw))
+	for addr := range raw {
+		addresses = append(addresses, addr)
+	}
+	r, err := m.cachedPois(addresses)
+	if err != nil {
+		m.log.Errorf("Reading geocode cache fails, err: %v", err)
+		r = map[string]Poi{}
+	}
+	missing := []string{}
+	for _, addr := range addresses {
+		if _, ok := r[addr]; !ok {
+			missing = append(missing, addr)
+		}
+	}
+	m.log.Infof("%d distinct addresses, %d from cache, %d to geocode", len(addresses), len(addresses)-len(missing), len(missing))
+	metrics.cache.Add(float64(len(addresses)-len(missing)), "geocode", "hit")
+	metrics.cache.Add(float64(len(missing)), "geocode", "miss")
+	if len(missing) == 0 {
+		return r, nil
+	}
+
+	ctx, cancel := context.WithCancel(m.interrupted)
+	defer cancel()
+	m.progress.Start(stage_geocode, map[string]int{"": len(missing)})
+	defer m.progress.End()
+	tasks := make(chan Task)
+	results := make(chan geocodeResult, m.cfg.Workers)
+	go func() {
+		defer close(tasks)
+		for _, addr := range missing {
+			addr := addr
+			task := func(ctx context.Context) {
+				poi, err := m.getPoi(ctx, raw[addr])
+				results <- geocodeResult{address: addr, poi: poi, err: err}
+			}
+			select {
+			case tasks <- task:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		newPool(m.cfg.Workers, m.limiter).Run(ctx, m.calls, tasks)
+		close(results)
+	}()
+
+	var werr error
+	for result := range results {
+		if result.err != nil {
+			if !isReleased(result.err) {
+				m.progress.Add("", result.err)
+				m.log.WithField("address", raw[result.address]).Errorf("Getting poi for %v fails, err: %v", raw[result.address], result.err)
+			}
+			continue
+		}
+		m.progress.Add("", nil)
+		r[result.address] = result.poi
+		if werr != nil {
+			continue
+		}
+		g := Geocode{
+			Region:     m.cfg.Region,
+			Address:    result.address,
+			Raw:        raw[result.address],
+			Poi:        result.poi,
+			ComputedAt: time.Now(),
+		}
+		werr = m.geocodeWriter.Upsert(m.ctx, bson.M{"region": g.Region, "address": g.Address}, g)
+		if werr != nil {
+			cancel()
+		}
+	}
+	if werr != nil {
+		return nil, werr
+	}
+	if err := m.geocodeWriter.Flush(m.ctx); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (m *Map) getAllPoi() error {
+	m.log.Infof("Get poi for address")
+	raw := map[string]string{}
+	for _, p := range m.personSlice {
+		if isZeroPoi(p.Poi) {
+			raw[normalizeAddress(p.Address)] = p.Address
+		} else {
+			m.log.Debugf("Poi(%+v) exists for %v", p.Poi, p.Name)
+		}
+	}
+	for _, o := range m.officeSlice {
+		if isZeroPoi(o.Poi) {
+			raw[normalizeAddress(o.Address)] = o.Address
+		} else {
+			m.log.Debugf("Poi(%+v) exists for %v", o.Poi, o.Name)
+		}
+	}
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := m.geocodes().EnsureIndexes(m.ctx, []string{"region,address"}, nil); err != nil {
+		m.log.Errorf("Creating geocode indexes fails, err: %v", err)
+	}
+	pois, err := m.geocodeAll(raw)
+	if err != nil {
+		return err
+	}
+
+	for index := range m.personSlice {
+		person := &m.personSlice[index]
+		poi, ok := pois[normalizeAddress(person.Address)]
+		if !isZeroPoi(person.Poi) || !ok {
+			continue
+		}
+		person.Poi = poi
+		if err := m.entityWriter.UpsertId(m.ctx, person.Id, person); err != nil {
+			return err
+		}
+	}
+	for index := range m.officeSlice {
+		office := &m.officeSlice[index]
+		poi, ok := pois[normalizeAddress(office.Address)]
+		if !isZeroPoi(office.Poi) || !ok {
+			continue
+		}
+		office.Poi = poi
+		if err := m.entityWriter.UpsertId(m.ctx, office.Id, office); err != nil {
+			return err
+		}
+	}
+	if err := m.entityWriter.Flush(m.ctx); err != nil {
+		return err
+	}
+	return m.interruptErr()
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"上海市 浦东新区１号", "上海市浦东新区1号"},
+		{"上海市　浦东新区\t1号", "上海市浦东新区1号"},
+		{"Century Ave. Ｂ座", "centuryave.b座"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := normalizeAddress(tt.addr); got != tt.want {
+			t.Errorf("normalizeAddress(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	path_matrix      = "/routematrix/v2/%s?origins=%s&destinations=%s,%s&output=json&ak="
+	default_bearings = 16
+	default_rings    = 8
+	reach_margin     = 1.3 // sampled beyond the distance covered at the mode's speed
+)
+
+var (
+	matrix_path = map[string]string{"walk": "walking", "ride": "riding", "drive": "driving"}
+	// mode_speed is a rough speed in km/h, only used to size the sampled area
+	mode_speed = map[string]float64{"walk": 5, "ride": 15, "transport": 25, "drive": 40}
+)
+
+type MatrixElement struct {
+	Duration struct {
+		Value int `json:"value"`
+	} `json:"duration"`
+}
+
+type MatrixResp struct {
+	Status  int             `json:"status"`
+	Message string          `json:"message"`
+	Result  []MatrixElement `json:"result"`
+}
+
+// GeoJSON types, coordinates are lng, lat.
+type Feature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   Geometry               `json:"geometry"`
+}
+
+type Geometry struct {
+	Type        string        `json:"type"`
+	Coordinates [][][]float64 `json:"coordinates"`
+}
+
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+// calMatrix routes every origin to dest by one call of the route matrix
+// api, no_route for the pairs without a route.
+func (m *Map) calMatrix(ctx context.Context, origins []Poi, dest Poi, mode string) ([]int, error) {
+	m.progress.Call(mode)
+	points := make([]string, len(origins))
+	for k, o := range origins {
+		points[k] = fmt.Sprintf("%f,%f", o.Lat, o.Lng)
+	}
+	path := fmt.Sprintf(path_matrix, matrix_path[mode], url.QueryEscape(strings.Join(points, "|")), fmt.Sprintf("%f", dest.Lat), fmt.Sprintf("%f", dest.Lng)) + m.cfg.AK
+	sn := generateSN(path, m.cfg.SK)
+	start := time.Now()
+	resp, err := m.restyClient.R().SetContext(ctx).Get(host + path + "&sn=" + sn)
+	if err != nil {
+		observeRequest("matrix_"+mode, start, "error")
+		return nil, redactError(err)
+	}
+	var matrix MatrixResp
+	if err := json.Unmarshal(resp.Body(), &matrix); err != nil {
+		observeRequest("matrix_"+mode, start, fmt.Sprintf("http_%d", resp.StatusCode()))
+		return nil, fmt.Errorf("Parse resp data fails, err: %v", err)
+	}
+	observeRequest("matrix_"+mode, start, strconv.Itoa(matrix.Status))
+	if matrix.Status != 0 || len(matrix.Result) != len(origins) {
+		return nil, &apiError{
+			Status:  matrix.Status,
+			Message: matrix.Message,
+			err:     fmt.Errorf("Can not get route matrix (%v) from server, status: %v, message: %v", mode, matrix.Status, matrix.Message),
+		}
+	}
+	r := make([]int, len(origins))
+	for k, e := range matrix.Result {
+		r[k] = e.Duration.Value
+		if r[k] <= 0 {
+			r[k] = no_route
+		}
+	}
+	return r, nil
+}
+
+// destination returns the poi km away from o in the direction of bearing,
+// in degrees clockwise from north.
+func destination(o Poi, bearing, km float64) Poi {
+	lat1, lng1 := o.Lat*math.Pi/180, o.Lng*math.Pi/180
+	b, d := bearing*math.Pi/180, km/earth_radius_km
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(d) + math.Cos(lat1)*math.Sin(d)*math.Cos(b))
+	lng2 := lng1 + math.Atan2(math.Sin(b)*math.Sin(d)*math.Cos(lat1), math.Cos(d)-math.Sin(lat1)*math.Sin(lat2))
+	return Poi{Lat: lat2 * 180 / math.Pi, Lng: lng2 * 180 / math.Pi}
+}
+
+// radialSamples returns the points on rings around the office, by bearing
+// then by ring, out to radius km.
+func radialSamples(office Poi, bearings, rings int, radius float64) []Poi {
+	r := make([]Poi, 0, bearings*rings)
+	for b := 0; b < bearings; b++ {
+		for k := 1; k <= rings; k++ {
+			r = append(r, destination(office, float64(b)*360/float64(bearings), radius*float64(k)/float64(rings)))
+		}
+	}
+	return r
+}
+
+// sampleTimes routes every sample to the office by one mode, with the route
+// matrix where the mode has one and pair by pair otherwise.
+func (m *Map) sampleTimes(office Poi, samples []Poi, mode string) []int {
+	r := make([]int, len(samples))
+	for k := range r {
+		r[k] = no_route
+	}
+	var lock sync.Mutex
+	tasks := make(chan Task)
+	go func() {
+		defer close(tasks)
+		step := 1
+		if containsString(matrixModes, mode) {
+			step = matrix_elements
+		}
+		for from := 0; from < len(samples); from += step {
+			from, to := from, from+step
+			if to > len(samples) {
+				to = len(samples)
+			}
+			task := func(ctx context.Context) {
+				var seconds []int
+				var err error
+				if step == 1 {
+					route, rerr := m.calRoute(ctx, samples[from], office, mode)
+					seconds, err = []int{route.Duration}, rerr
+				} else {
+					seconds, err = m.calMatrix(ctx, samples[from:to], office, mode)
+				}
+				if err != nil {
+					m.log.Debugf("Routing %v samples %d-%d fails, err: %v", mode, from, to, err)
+					return
+				}
+				lock.Lock()
+				copy(r[from:to], seconds)
+				lock.Unlock()
+			}
+			select {
+			case tasks <- task:
+			case <-m.interrupted.Done():
+				return
+			}
+		}
+	}()
+	newPool(m.cfg.Workers, m.limiter).Run(m.interrupted, m.calls, tasks)
+	return r
+}
+
+// contour returns the ring of the area reached within seconds: on every
+// bearing the distance where the commute crosses the threshold, linearly
+// interpolated between the rings. Commutes are assumed to grow along a
+// bearing, the first crossing counts. The ring is counterclockwise as
+// GeoJSON wants it.
+func contour(office Poi, times []int, bearings, rings int, radius float64, seconds int) ([][]float64, bool) {
+	ring := [][]float64{}
+	reached := false
+	for b := 0; b < bearings; b++ {
+		prevKm, prevTime, km := 0.0, 0, 0.0
+		for k := 1; k <= rings; k++ {
+			t, dist := times[b*rings+k-1], radius*float64(k)/float64(rings)
+			if t == no_route {
+				km = prevKm
+				break
+			}
+			if t > seconds {
+				km = prevKm + (dist-prevKm)*float64(seconds-prevTime)/float64(t-prevTime)
+				break
+			}
+			prevKm, prevTime, km = dist, t, dist
+		}
+		if km > 0 {
+			reached = true
+		}
+		p := destination(office, float64(b)*360/float64(bearings), km)
+		ring = append(ring, []float64{p.Lng, p.Lat})
+	}
+	for a, b := 0, len(ring)-1; a < b; a, b = a+1, b-1 {
+		ring[a], ring[b] = ring[b], ring[a]
+	}
+	ring = append(ring, ring[0])
+	return ring, reached
+}
+
+// parseThresholds parses a comma separated list of minutes.
+func parseThresholds(s string) ([]int, error) {
+	r := []int{}
+	for _, f := range strings.Split(s, ",") {
+		t, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || t <= 0 {
+			return nil, fmt.Errorf("invalid threshold: %v", f)
+		}
+		r = append(r, t)
+	}
+	return r, nil
+}
+
+// isochrones samples rings of points around the offices, or the offices
+// named, routes them to the office by every mode and writes the areas
+// reached within every threshold as a GeoJSON FeatureCollection next to the
+// workbook.
+func (m *Map) isochrones(names []string) error {
+	thresholds, err := parseThresholds(m.cfg.Thresholds)
+	if err != nil {
+		return err
+	}
+	if m.cfg.Bearings < 3 || m.cfg.Rings < 1 {
+		return fmt.Errorf("need 3 bearings and 1 ring at least")
+	}
+	longest := 0
+	for _, t := range thresholds {
+		if t > longest {
+			longest = t
+		}
+	}
+	m.logFields.setStage(stage_load)
+	if err := m.loadExecelData(m.cfg.ExcelFile); err != nil {
+		return err
+	}
+	offices := []Office{}
+	for _, o := range m.officeSlice {
+		if len(names) == 0 || containsString(names, o.Name) {
+			offices = append(offices, o)
+		}
+	}
+	if len(offices) == 0 {
+		return fmt.Errorf("no such office: %v", strings.Join(names, ", "))
+	}
+	// only the offices are geocoded
+	m.personSlice = nil
+	m.officeSlice = offices
+	m.logFields.setStage(stage_geocode)
+	if err := m.getAllPoi(); err != nil {
+		return err
+	}
+
+	m.logFields.setStage(stage_route)
+	collection := FeatureCollection{Type: "FeatureCollection", Features: []Feature{}}
+	for _, o := range m.officeSlice {
+		if isZeroPoi(o.Poi) {
+			m.log.Warnf("No poi for %v, skipped", o.Name)
+			continue
+		}
+		for _, mode := range m.cfg.Modes {
+			radius := mode_speed[mode] * float64(longest) / 60 * reach_margin
+			samples := radialSamples(o.Poi, m.cfg.Bearings, m.cfg.Rings, radius)
+			m.log.Infof("Route %d samples within %.1f km of %v by %v", len(samples), radius, o.Name, mode)
+			times := m.sampleTimes(o.Poi, samples, mode)
+			if err := m.interruptErr(); err != nil {
+				return err
+			}
+			for _, t := range thresholds {
+				ring, reached := contour(o.Poi, times, m.cfg.Bearings, m.cfg.Rings, radius, t*60)
+				if !reached {
+					m.log.Warnf("Nothing reaches %v within %d minutes by %v", o.Name, t, mode)
+					continue
+				}
+				collection.Features = append(collection.Features, Feature{
+					Type: "Feature",
+					Properties: map[string]interface{}{
+						"office":  o.Name,
+						"address": o.Address,
+						"mode":    mode,
+						"minutes": t,
+					},
+					Geometry: Geometry{Type: "Polygon", Coordinates: [][][]float64{ring}},
+				})
+			}
+		}
+	}
+	data, err := json.MarshalIndent(collection, "", "  ")
+	if err != nil {
+		return err
+	}
+	file := strings.TrimSuffix(m.cfg.ExcelFile, filepath.Ext(m.cfg.ExcelFile)) + ".isochrones.geojson"
+	m.log.Infof("Write %d isochrones to %v", len(collection.Features), file)
+	return ioutil.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestParseThresholds(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []int
+		wantErr bool
+	}{
+		{"15,30, 45", []int{15, 30, 45}, false},
+		{"20", []int{20}, false},
+		{"15,,30", nil, true},
+		{"0", nil, true},
+		{"half", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseThresholds(tt.s)
+		if !reflect.DeepEqual(got, tt.want) || (err != nil) != tt.wantErr {
+			t.Errorf("parseThresholds(%q) = %v, %v, want %v, error %v", tt.s, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestContour(t *testing.T) {
+	office := Poi{Lat: 31.2, Lng: 121.5}
+	tests := []struct {
+		name        string
+		times       []int // two rings on every bearing
+		seconds     int
+		wantKm      float64
+		wantReached bool
+	}{
+		{"between the rings", []int{300, 900}, 600, 1.5, true},
+		{"within the first ring", []int{300, 900}, 100, 1.0 / 3, true},
+		{"beyond the last ring", []int{300, 900}, 1200, 2, true},
+		{"no route", []int{no_route, 900}, 600, 0, false},
+		{"no route further out", []int{300, no_route}, 600, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			times := []int{}
+			for b := 0; b < 4; b++ {
+				times = append(times, tt.times...)
+			}
+			ring, reached := contour(office, times, 4, 2, 2, tt.seconds)
+			if reached != tt.wantReached || len(ring) != 5 || !reflect.DeepEqual(ring[0], ring[4]) {
+				t.Fatalf("contour() = %v, %v, want a closed ring of 4 points, reached %v", ring, reached, tt.wantReached)
+			}
+			for _, p := range ring {
+				if km := distanceKm(office, Poi{Lng: p[0], Lat: p[1]}); math.Abs(km-tt.wantKm) > 0.01 {
+					t.Errorf("point %v is %.3f km away, want %.3f", p, km, tt.wantKm)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	job_pending   = "pending"
+	job_in_flight = "in_flight"
+	job_done      = "done"
+	job_failed    = "failed"
+)
+
+// Job is the ledger entry of one route from a person to an office by one
+// mode. A job is leased while it is in flight; when the process holding the
+// lease dies, the job becomes runnable again once the lease expires.
+type Job struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty"`
+	PersonId   primitive.ObjectID `bson:"person_id"`
+	OfficeId   primitive.ObjectID `bson:"office_id"`
+	Mode       string             `bson:"mode"`
+	DepartAt   string             `bson:"depart_at,omitempty"` // of the coordinator that synced it
+	State      string             `bson:"state"`
+	Attempts   int                `bson:"attempts"`
+	Owner      string             `bson:"owner,omitempty"`
+	LeaseUntil time.Time          `bson:"lease_until,omitempty"`
+	Error      string             `bson:"error,omitempty"`
+	UpdatedAt  time.Time          `bson:"updated_at"`
+	// Workbooks are the workbooks the job was synced for, a route is shared
+	// by every workbook with the same person and office.
+	Workbooks []string `bson:"workbooks,omitempty"`
+}
+
+type jobCount struct {
+	Id struct {
+		PersonId primitive.ObjectID `bson:"person_id"`
+		State    string             `bson:"state"`
+	} `bson:"_id"`
+	Count int `bson:"count"`
+}
+
+func (m *Map) jobs() *qmgo.Collection {
+	return m.mongoCli.Database.Collection(mongo_collection_jobs)
+}
+
+func (m *Map) ensureJobIndexes() error {
+	return m.jobs().EnsureIndexes(m.ctx, []string{"person_id,office_id,mode"}, []string{"state,lease_until", "workbooks,state"})
+}
+
+// workbookKey identifies the workbook of the run in the jobs.
+func (m *Map) workbookKey() string {
+	if file, err := filepath.Abs(m.cfg.ExcelFile); err == nil {
+		return file
+	}
+	return m.cfg.ExcelFile
+}
+
+// processOwner identifies this process in the leases it takes.
+func processOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v-%d", host, os.Getpid())
+}
+
+// syncDeparture makes the jobs of the workbook route at the departure time
+// of the run. Jobs of another departure are routed again, while jobs leased
+// at another departure fail the run: the store keeps one duration per pair
+// and mode, two departures routed at once would mix.
+func (m *Map) syncDeparture() error {
+	now := time.Now()
+	other := m.workbookFilter()
+	other["depart_at"] = bson.M{"$exists": true, "$ne": m.cfg.DepartAt}
+	leased := bson.M{"state": job_in_flight, "lease_until": bson.M{"$gte": now}}
+	for k, v := range other {
+		leased[k] = v
+	}
+	n, err := m.jobs().Find(m.ctx, leased).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%d routes of the workbook are being routed at another departure time than %v, wait for them or run with that -depart-at", n, m.cfg.DepartAt)
+	}
+	_, err = m.jobs().UpdateAll(m.ctx, other, bson.M{
+		"$set":   bson.M{"state": job_pending, "attempts": 0, "depart_at": m.cfg.DepartAt, "updated_at": now},
+		"$unset": bson.M{"owner": "", "lease_until": "", "error": ""},
+	})
+	if err != nil {
+		return err
+	}
+	// jobs synced before the departure was recorded on them
+	legacy := m.workbookFilter()
+	legacy["depart_at"] = bson.M{"$exists": false}
+	_, err = m.jobs().UpdateAll(m.ctx, legacy, bson.M{"$set": bson.M{"depart_at": m.cfg.DepartAt}})
+	return err
+}
+
+// syncJobs makes sure every person × office × mode of the workbook within
+// reach has a job. Existing jobs keep their state.
+func (m *Map) syncJobs() error {
+	if err := m.syncDeparture(); err != nil {
+		return err
+	}
+	now := time.Now()
+	workbook := m.workbookKey()
+	for _, p := range m.personSlice {
+		for _, o := range m.officeSlice {
+			if !m.withinReach(p.Poi, o.Poi) {
+				continue
+			}
+			for _, mode := range m.cfg.Modes {
+				update := bson.M{
+					"$setOnInsert": bson.M{"state": job_pending, "attempts": 0, "depart_at": m.cfg.DepartAt, "updated_at": now},
+					"$addToSet":    bson.M{"workbooks": workbook},
+				}
+				if err := m.jobWriter.UpdateOne(m.ctx, pairFilter(p.Id, o.Id, mode), update, true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return m.jobWriter.Flush(m.ctx)
+}
+
+// resetJobs puts the jobs matching filter back to pending, e.g. after an
+// address change.
+func (m *Map) resetJobs(filter bson.M) error {
+	_, err := m.jobs().UpdateAll(m.ctx, filter, bson.M{
+		"$set":   bson.M{"state": job_pending, "attempts": 0, "updated_at": time.Now()},
+		"$unset": bson.M{"owner": "", "lease_until": "", "error": ""},
+	})
+	return err
+}
+
+// runnableFilter matches the jobs that may be claimed: pending ones, those
+// whose lease expired and failed ones with attempts left.
+func (m *Map) runnableFilter(now time.Time) bson.M {
+	return bson.M{"$or": []bson.M{
+		{"state": job_pending},
+		{"state": job_in_flight, "lease_until": bson.M{"$lt": now}},
+		{"state": job_failed, "attempts": bson.M{"$lt": m.cfg.MaxAttempts}},
+	}}
+}
+
+// workbookFilter restricts jobs to the loaded persons, offices and modes.
+func (m *Map) workbookFilter() bson.M {
+	personIds, officeIds := m.loadedIds()
+	return bson.M{
+		"person_id": bson.M{"$in": personIds},
+		"office_id": bson.M{"$in": officeIds},
+		"mode":      bson.M{"$in": m.cfg.Modes},
+	}
+}
+
+// commitJobs marks finished jobs done or failed, and puts the jobs stopped
+// by a shutdown back to pending. The durations are flushed first, so a job
+// is never done without its duration being stored. The attempts are set
+// from the claimed job rather than incremented, so a batch sent again by the
+// writer does not count an attempt twice. Only jobs still leased by this
+// process under the same lease are updated: once a lease expired, the job
+// may have been claimed by another process, which commits it instead.
+func (m *Map) commitJobs(finished []RouteResult) error {
+	if err := m.durationWriter.Flush(m.ctx); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, result := range finished {
+		update := bson.M{
+			"$set":   bson.M{"state": job_done, "updated_at": now},
+			"$unset": bson.M{"owner": "", "lease_until": "", "error": ""},
+		}
+		if isReleased(result.Err) {
+			update = bson.M{
+				"$set":   bson.M{"state": job_pending, "updated_at": now},
+				"$unset": bson.M{"owner": "", "lease_until": ""},
+			}
+		} else if result.Err != nil {
+			update = bson.M{
+				"$set":   bson.M{"state": job_failed, "attempts": result.Job.Attempts + 1, "error": result.Err.Error(), "updated_at": now},
+				"$unset": bson.M{"owner": "", "lease_until": ""},
+			}
+		}
+		filter := bson.M{"_id": result.Job.Id, "owner": m.owner, "lease_until": result.Job.LeaseUntil}
+		if err := m.jobWriter.UpdateOne(m.ctx, filter, update, false); err != nil {
+			return err
+		}
+	}
+	return m.jobWriter.Flush(m.ctx)
+}
+
+// showResume prints the jobs that are left for the -excel workbook. Jobs
+// synced before the workbooks were recorded on them are not counted until
+// the workbook runs again.
+func (m *Map) showResume() error {
+	workbook := m.workbookKey()
+	fmt.Printf("Routes of %v\n", workbook)
+	pipeline := []bson.M{
+		{"$match": bson.M{"workbooks": workbook}},
+		{"$group": bson.M{
+			"_id":   bson.M{"person_id": "$person_id", "state": "$state"},
+			"count": bson.M{"$sum": 1},
+		}},
+	}
+	counts := []jobCount{}
+	if err := m.jobs().Aggregate(m.ctx, pipeline).All(&counts); err != nil {
+		return err
+	}
+	total := map[string]int{}
+	left := map[primitive.ObjectID]map[string]int{}
+	for _, c := range counts {
+		total[c.Id.State] += c.Count
+		if c.Id.State == job_done {
+			continue
+		}
+		if left[c.Id.PersonId] == nil {
+			left[c.Id.PersonId] = map[string]int{}
+		}
+		left[c.Id.PersonId][c.Id.State] += c.Count
+	}
+	for _, state := range []string{job_pending, job_in_flight, job_failed, job_done} {
+		fmt.Printf("%-10v %d\n", state, total[state])
+	}
+
+	expired, err := m.jobs().Find(m.ctx, bson.M{"workbooks": workbook, "state": job_in_flight, "lease_until": bson.M{"$lt": time.Now()}}).Count()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d in flight jobs have an expired lease and will be run again\n", expired)
+	exhausted, err := m.jobs().Find(m.ctx, bson.M{"workbooks": workbook, "state": job_failed, "attempts": bson.M{"$gte": m.cfg.MaxAttempts}}).Count()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d failed jobs have no attempts left\n", exhausted)
+	if len(left) == 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(left))
+	for id := range left {
+		ids = append(ids, id)
+	}
+	persons := []Person{}
+	if err := m.mongoCli.Find(m.ctx, bson.M{"_id": bson.M{"$in": ids}}).All(&persons); err != nil {
+		return err
+	}
+	fmt.Printf("Persons with routes left:\n")
+	for _, p := range persons {
+		c := left[p.Id]
+		fmt.Printf("\t%v: pending %d, in flight %d, failed %d\n", p.Name, c[job_pending], c[job_in_flight], c[job_failed])
+	}
+	return nil
+}
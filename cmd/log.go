@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	runtime "github.com/banzaicloud/logrus-runtime-formatter"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	log_format_text = "text"
+	log_format_json = "json"
+	redacted        = "***"
+)
+
+// secretParams matches the api key and the signature in urls.
+var secretParams = regexp.MustCompile(`([?&](?:ak|sn)=)[^&\s"']*`)
+
+// apiError is an answer of the baidu api with a status other than 0.
+type apiError struct {
+	Status  int
+	Message string
+	err     error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+// logFields are added to every log line of the process.
+type logFields struct {
+	lock  sync.Mutex
+	runId string
+	stage string
+}
+
+func (f *logFields) setRun(runId string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.runId = runId
+}
+
+func (f *logFields) setStage(stage string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.stage = stage
+}
+
+// logHook adds the run and stage to every entry and removes the keys of the
+// baidu api from it, whatever logged them.
+type logHook struct {
+	fields  *logFields
+	secrets []string
+}
+
+func (h *logHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logHook) Fire(entry *logrus.Entry) error {
+	h.fields.lock.Lock()
+	if h.fields.runId != "" {
+		entry.Data["run_id"] = h.fields.runId
+	}
+	if h.fields.stage != "" {
+		entry.Data["stage"] = h.fields.stage
+	}
+	h.fields.lock.Unlock()
+	entry.Message = h.redact(entry.Message)
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = h.redact(v)
+		case error:
+			entry.Data[k] = h.redact(v.Error())
+		}
+	}
+	return nil
+}
+
+func (h *logHook) redact(s string) string {
+	s = secretParams.ReplaceAllString(s, "${1}"+redacted)
+	for _, secret := range h.secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return s
+}
+
+// redactError hides the signed url of a failed request, keeping the error
+// it wraps so that cancellations are still recognised.
+func redactError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		ue.URL = secretParams.ReplaceAllString(ue.URL, "${1}"+redacted)
+	}
+	return err
+}
+
+// setupLogger applies the log flags to log and installs the hook adding the
+// fields of the run.
+func setupLogger(log *logrus.Logger, cfg *Config, fields *logFields) error {
+	level, err := logrus.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	switch cfg.LogFormat {
+	case log_format_text:
+	case log_format_json:
+		log.SetFormatter(&runtime.Formatter{
+			ChildFormatter: &logrus.JSONFormatter{},
+			Line:           true,
+			File:           true,
+			BaseNameOnly:   true,
+		})
+	default:
+		return fmt.Errorf("unknown log format: %v", cfg.LogFormat)
+	}
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	log.AddHook(&logHook{fields: fields, secrets: []string{cfg.AK, cfg.SK}})
+	return nil
+}
+
+// routeFields are the fields of a log line about a route.
+func routeFields(job RouteJob, err error) logrus.Fields {
+	fields := logrus.Fields{"mode": job.Mode, "job_id": job.Id.Hex(), "person_id": job.PersonId.Hex(), "office_id": job.OfficeId.Hex()}
+	if job.Person != nil {
+		fields["person"] = job.Person.Name
+	}
+	if job.Office != nil {
+		fields["office"] = job.Office.Name
+	}
+	var ae *apiError
+	if errors.As(err, &ae) {
+		fields["baidu_status"] = ae.Status
+	}
+	return fields
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRouteFields(t *testing.T) {
+	personId, officeId := primitive.NewObjectID(), primitive.NewObjectID()
+	tests := []struct {
+		name       string
+		job        RouteJob
+		wantPerson interface{}
+	}{
+		{"resolved", RouteJob{PersonId: personId, OfficeId: officeId, Person: &Person{Id: personId, Name: "li"}, Office: &Office{Id: officeId, Name: "east"}}, "li"},
+		{"not in the store", RouteJob{PersonId: personId, OfficeId: officeId}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := routeFields(tt.job, nil)
+			if fields["person_id"] != personId.Hex() || fields["office_id"] != officeId.Hex() || fields["person"] != tt.wantPerson {
+				t.Errorf("routeFields() = %v", fields)
+			}
+		})
+	}
+}
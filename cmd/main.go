@@ -5,15 +5,15 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	_ "io/ioutil"
 	_ "net/http"
 	"net/url"
 	"os"
-	"sort"
+	"path/filepath"
 	"strconv"
-	_ "strings"
-	"sync"
+	"strings"
 	"time"
 
 	runtime "github.com/banzaicloud/logrus-runtime-formatter"
@@ -26,34 +26,61 @@ import (
 )
 
 const (
-	max_workers                = 40
-	MIN                        = 0.00000001
-	nearest_offices            = 10
-	nearest_persons            = 20
-	mongo_url                  = "mongodb://10.249.64.55:27017"
-	mongo_database             = "local"
-	mongo_collection           = "pingan"
-	myak                       = "w5i9dYBqFBNR3ukdvsfpuEe40Cr53OSl"
-	sk                         = "TGXfG0jcHTegDV0aSpQXRMtApCANqtOe"
-	place                      = "/place/v2/search?query=%s&region=%s&output=json&ak=" + myak
-	path_transport             = "/directionlite/v1/transit?origin=%s,%s&destination=%s,%s&timestamp=%s&ak=" + myak
-	path_walk                  = "/directionlite/v1/walking?origin=%s,%s&destination=%s,%s&timestamp=%s&ak=" + myak
-	path_drive                 = "/directionlite/v1/driving?origin=%s,%s&destination=%s,%s&timestamp=%s&ak=" + myak
-	path_ride                  = "/directionlite/v1/riding?origin=%s,%s&destination=%s,%s&timestamp=%s&ak=" + myak
-	office_number_max          = 100
-	person_number_max          = 200
-	default_region             = "上海"
-	host                       = "http://api.map.baidu.com"
-	execel_file                = "data.xlsx"
-	sheet_person               = "persons"
-	sheet_office               = "offices"
-	sheet_person_name_index    = 0
-	sheet_person_address_index = 1
-	sheet_person_path_index    = 2
-	sheet_person_result_start  = 'D'
-	sheet_office_name_index    = 0
-	sheet_office_address_index = 1
-	sheet_office_result_start  = 'C'
+	max_workers                   = 40
+	MIN                           = 0.00000001
+	nearest_offices               = 10
+	nearest_persons               = 20
+	bulk_size                     = 500
+	default_qps                   = 30
+	write_retries                 = 3
+	max_attempts                  = 3
+	lease_duration                = 10 * time.Minute
+	batch_size                    = 100
+	poll_interval                 = 10 * time.Second
+	idle_timeout                  = 5 * time.Minute
+	grace_period                  = 30 * time.Second
+	daily_quota                   = 30000
+	call_latency                  = 300 * time.Millisecond // typical latency of a baidu api call
+	matrix_elements               = 50                     // origins × destinations allowed in one matrix call
+	mongo_url                     = "mongodb://10.249.64.55:27017"
+	mongo_database                = "local"
+	mongo_collection              = "pingan"
+	mongo_collection_runs         = "runs"
+	mongo_collection_run_persons  = "run_persons"
+	mongo_collection_run_offices  = "run_offices"
+	mongo_collection_durations    = "durations"
+	mongo_collection_geocodes     = "geocodes"
+	mongo_collection_jobs         = "jobs"
+	mongo_collection_service_jobs = "service_jobs"
+	default_listen                = "127.0.0.1:8080"
+	default_data_dir              = "uploads"
+	myak                          = "w5i9dYBqFBNR3ukdvsfpuEe40Cr53OSl"
+	sk                            = "TGXfG0jcHTegDV0aSpQXRMtApCANqtOe"
+	place                         = "/place/v2/search?query=%s&region=%s&output=json&ak="
+	place_nearby                  = "/place/v2/search?query=%s&location=%s,%s&radius=%d&output=json&ak="
+	path_transport                = "/directionlite/v1/transit?origin=%s,%s&destination=%s,%s&timestamp=%s&ak="
+	path_walk                     = "/directionlite/v1/walking?origin=%s,%s&destination=%s,%s&timestamp=%s&ak="
+	path_drive                    = "/directionlite/v1/driving?origin=%s,%s&destination=%s,%s&timestamp=%s&ak="
+	path_ride                     = "/directionlite/v1/riding?origin=%s,%s&destination=%s,%s&timestamp=%s&ak="
+	office_number_max             = 100
+	person_number_max             = 200
+	default_region                = "上海"
+	host                          = "http://api.map.baidu.com"
+	execel_file                   = "data.xlsx"
+	sheet_person                  = "persons"
+	sheet_office                  = "offices"
+	sheet_person_name_index       = 0
+	sheet_person_address_index    = 1
+	sheet_person_path_index       = 2
+	sheet_person_result_start     = 'D'
+	sheet_office_name_index       = 0
+	sheet_office_address_index    = 1
+	sheet_office_result_start     = 'C'
+	sheet_office_capacity_index   = int(sheet_office_result_start-'A') + nearest_persons // after the results, empty for no limit
+	sheet_person_assigned_col     = sheet_person_result_start + nearest_offices
+	sheet_person_current_index    = sheet_person_assigned_col - 'A' + 2 // after the assigned office and its rank
+	sheet_person_seniority_index  = sheet_person_current_index + 1      // offices rank higher seniority first
+	sheet_person_preference_index = sheet_person_current_index + 2      // offices in order of preference from here on
 )
 
 var (
@@ -64,16 +91,36 @@ var (
 )
 
 type Map struct {
-	restyClient   *resty.Client
-	ctx           context.Context
-	mongoCli      *qmgo.QmgoClient
-	log           *logrus.Logger
-	excelFile     *excelize.File
-	personSlice   []Person
-	officeSlice   []Office
-	currentWorker int
-	lock          *sync.Mutex
-	wg            sync.WaitGroup
+	restyClient *resty.Client
+	// ctx is used for the store and only cancelled on abort, interrupted is
+	// cancelled on the first signal to stop scheduling new work, and calls
+	// is cancelled once in-flight api calls ran out of time.
+	ctx            context.Context
+	interrupted    context.Context
+	calls          context.Context
+	mongoCli       *qmgo.QmgoClient
+	log            *logrus.Logger
+	cfg            *Config
+	run            *Run
+	entityWriter   *BulkWriter
+	durationWriter *BulkWriter
+	geocodeWriter  *BulkWriter
+	jobWriter      *BulkWriter
+	owner          string
+	localRouting   bool
+	dryRun         bool
+	limiter        *Limiter
+	progress       *Progress
+	objectiveStats []ObjectiveStats
+	preferences    *Preferences
+	constraints    *Constraints
+	moves          []Move
+	reach          []Reach
+	uncovered      []Uncovered
+	logFields      *logFields
+	excelFile      *excelize.File
+	personSlice    []Person
+	officeSlice    []Office
 }
 
 type Poi struct {
@@ -81,23 +128,20 @@ type Poi struct {
 	Lng float64 `json:"lng" bson:"lng"`
 }
 
-type Duration struct {
-	Sort         []string       // sort according to the duration [drive, transport, ride, walk]
-	DurationPath map[string]int `bson:"duration_path"` // key: walk/drive/ride/transport
-}
-
 type Person struct {
-	Id               primitive.ObjectID        `bson:"_id,omitempty"`
-	Name             string                    `bson:"name"`
-	Address          string                    `bson:"address"`
-	CanDrive         bool                      `bson:"can_drive"`
-	Poi              Poi                       `bson:"poi,omitempty"`
-	DurationMap      map[string]Duration       `bson:"duration_map,omitempty"`    // key: office.name
-	NearestOffices   [nearest_offices]string   `bson:"nearest_offices,omitempty"` // save 10 nearest offices
-	NearestDurations [nearest_offices]int      `bson:"nearest_durations,omitempty"`
-	SortList         []int                     `bson:"sort_list,omitempty"` // ordered duration value
-	SortMap          map[int][]DesignateOffice `bson:"sort_map,omitempty"`  // get office by the ordered duration value
-	Done             bool                      `bson:"done,omitempty"`
+	Id               primitive.ObjectID      `bson:"_id,omitempty"`
+	Name             string                  `bson:"name"`
+	Address          string                  `bson:"address"`
+	CanDrive         bool                    `bson:"can_drive"`
+	Poi              Poi                     `bson:"poi,omitempty"`
+	NearestOffices   [nearest_offices]string `bson:"-"` // save 10 nearest offices, computed from durations
+	NearestDurations [nearest_offices]int    `bson:"-"`
+	AssignedOffice   string                  `bson:"-"` // set by the assignment stage
+	AssignedRank     int                     `bson:"-"` // rank of the assigned office in the person's ranking
+	AssignedMinutes  int                     `bson:"-"`
+	CurrentOffice    string                  `bson:"-"` // read from the workbook for rebalancing
+	Seniority        float64                 `bson:"-"` // read from the workbook for stable matching
+	Preferences      []string                `bson:"-"`
 }
 
 type Dummy struct {
@@ -111,17 +155,36 @@ type Office struct {
 	Name     string             `bson:"name"`
 	Address  string             `bson:"address"`
 	Poi      Poi                `bson:"poi,omitempty"`
-	SortMap  map[int][]Dummy    `bson:"sort_map,omitempty"`
-	SortList []Dummy            `bson:"sort_list,omitempty"`
+	SortList []Dummy            `bson:"-"` // persons ordered by duration, computed from durations
+	Capacity int                `bson:"-"` // headcount from the workbook, 0 for no limit
+	Assigned int                `bson:"-"` // persons assigned by the assignment stage
 }
 
-type DesignateOffice struct {
-	Path string
-	Name string
+// RouteJob is one route to calculate, Id is its entry in the job ledger.
+// Person and Office are nil when they are not in the store of the process.
+type RouteJob struct {
+	Id       primitive.ObjectID
+	PersonId primitive.ObjectID
+	OfficeId primitive.ObjectID
+	Person   *Person
+	Office   *Office
+	Mode     string
+	DepartAt string
+	Attempts int // of the ledger job when it was claimed
+	// LeaseUntil is the lease of the claim, the job is only committed while
+	// it still holds it
+	LeaseUntil time.Time
+}
+
+type RouteResult struct {
+	Job   RouteJob
+	Route Route
+	Err   error
 }
 
 type PlaceRespResult struct {
 	Name     string `json:"name"`
+	Address  string `json:"address"`
 	Location Poi    `json:"location"`
 }
 
@@ -174,8 +237,8 @@ func IsEqual(f1, f2 float64) bool {
 }
 
 /*Refer to http://lbsyun.baidu.com/apiconsole/key?application=key*/
-func generateSN(path string) string {
-	rawStr := url.QueryEscape(path + sk)
+func generateSN(path, secret string) string {
+	rawStr := url.QueryEscape(path + secret)
 	hasher := md5.New()
 	hasher.Write([]byte(rawStr))
 	hexStr := hex.EncodeToString(hasher.Sum(nil))
@@ -185,13 +248,11 @@ func generateSN(path string) string {
 func (m *Map) loadExecelData(file string) error {
 	f, err := excelize.OpenFile(file)
 	if err != nil {
-		m.log.Errorf("Can not load excel file, err: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("Can not load excel file, err: %v", err)
 	}
 	rows, err := f.GetRows(sheet_person)
 	if err != nil {
-		m.log.Errorf("Can not get rows, err: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("Can not get rows of %v, err: %v", sheet_person, err)
 	}
 	for index, row := range rows {
 		if index == 0 {
@@ -201,19 +262,18 @@ func (m *Map) loadExecelData(file string) error {
 			continue
 		}
 		name := row[sheet_person_name_index]
-		p := Person{
-			DurationMap: make(map[string]Duration, office_number_max),
-			SortMap:     make(map[int][]DesignateOffice, office_number_max),
-			Done:        false,
-		}
+		p := Person{}
 		err := m.mongoCli.Find(m.ctx, bson.M{"name": name}).One(&p)
 		if err != nil {
 			m.log.Debugf("%v does not exist, err: %v", name, err)
 			p.Name = name
 			p.Address = row[sheet_person_address_index]
 			p.CanDrive = string2Bool(row[sheet_person_path_index])
-			_, err = m.mongoCli.InsertOne(m.ctx, p)
-			m.log.Debugf("create new one, err: %v", err)
+			p.Id = primitive.NewObjectID()
+			if err := m.saveEntity(p.Id, p); err != nil {
+				return err
+			}
+			m.log.Debugf("create new one")
 		} else {
 			changes := false
 			if string2Bool(row[sheet_person_path_index]) != p.CanDrive {
@@ -226,28 +286,28 @@ func (m *Map) loadExecelData(file string) error {
 				p.Address = row[sheet_person_address_index]
 				p.Poi = Poi{Lat: 0, Lng: 0}
 				changes = true
+				m.resetRoutes(bson.M{"person_id": p.Id}, name)
 			}
 			if changes {
-				p.Done = false
-				_, err = m.mongoCli.UpsertId(m.ctx, p.Id, p)
 				m.log.Infof("%v's data changes, reset its result", name)
-				if err != nil {
-					m.log.Errorf("%v updating fails, err: %v", name, err)
+				if err := m.saveEntity(p.Id, p); err != nil {
+					return err
 				}
 			}
 		}
-		p.SortList = []int{}
-		p.SortMap = make(map[int][]DesignateOffice, office_number_max)
-		p.NearestOffices = [10]string{}
-		p.NearestDurations = [10]int{}
+		p.CurrentOffice = readCurrentOffice(row)
+		p.Seniority, err = readSeniority(row)
+		if err != nil {
+			return fmt.Errorf("Can not read the seniority of %v, err: %v", name, err)
+		}
+		p.Preferences = readPreferences(row)
 		m.personSlice = append(m.personSlice, p)
 		m.log.Debugf("Person: %v, %v", p.Name, p.Address)
 	}
 
 	rows, err = f.GetRows(sheet_office)
 	if err != nil {
-		m.log.Errorf("Can not get rows, err: %v", err)
-		os.Exit(1)
+		return fmt.Errorf("Can not get rows of %v, err: %v", sheet_office, err)
 	}
 	officeChanged := false
 	for index, row := range rows {
@@ -258,306 +318,371 @@ func (m *Map) loadExecelData(file string) error {
 			continue
 		}
 		name := row[sheet_office_name_index]
-		o := Office{
-			SortMap: make(map[int][]Dummy, person_number_max),
-		}
+		o := Office{}
 		err := m.mongoCli.Find(m.ctx, bson.M{"name": name}).One(&o)
 		if err != nil {
 			o.Name = name
 			o.Address = row[sheet_office_address_index]
-			_, err = m.mongoCli.InsertOne(m.ctx, o)
-			m.log.Debugf("%v does not exist, create new one, err: %v", name, err)
+			o.Id = primitive.NewObjectID()
+			if err := m.saveEntity(o.Id, o); err != nil {
+				return err
+			}
+			m.log.Debugf("%v does not exist, create new one", name)
 			officeChanged = true
 		} else {
 			if row[sheet_office_address_index] != o.Address {
 				m.log.Infof("%v's data changes(from %v to %v), reset its result", name, o.Address, row[sheet_office_address_index])
 				o.Address = row[sheet_office_address_index]
 				o.Poi = Poi{Lat: 0, Lng: 0}
-				_, err = m.mongoCli.UpsertId(m.ctx, o.Id, o)
-				if err != nil {
-					m.log.Errorf("%v updating fails, err: %v", name, err)
+				if err := m.saveEntity(o.Id, o); err != nil {
+					return err
 				}
+				m.resetRoutes(bson.M{"office_id": o.Id}, name)
 				officeChanged = true
 			}
 		}
-		o.SortMap = make(map[int][]Dummy, person_number_max)
 		o.SortList = []Dummy{}
+		o.Capacity, err = readCapacity(row, sheet_office_capacity_index)
+		if err != nil {
+			return fmt.Errorf("Can not read the capacity of office %v in column %c of %v, err: %v", name, 'A'+sheet_office_capacity_index, sheet_office, err)
+		}
 		m.officeSlice = append(m.officeSlice, o)
 		m.log.Debugf("Office: %v, %v", o.Name, o.Address)
 	}
 	if officeChanged {
-		m.log.Infof("Office changes, need reset result")
-		for i := range m.personSlice {
-			m.personSlice[i].Done = false
-		}
+		m.log.Infof("Office changes, new routes will be calculated")
 	}
 	m.excelFile = f
-	return nil
+	return m.entityWriter.Flush(m.ctx)
+}
+
+// setConfig sets the config and the writers and progress that depend on it.
+func (m *Map) setConfig(cfg *Config) {
+	m.cfg = cfg
+	m.entityWriter = newBulkWriter(m.mongoCli.Collection, cfg, m.log)
+	m.durationWriter = newBulkWriter(m.durations(), cfg, m.log)
+	m.geocodeWriter = newBulkWriter(m.geocodes(), cfg, m.log)
+	m.jobWriter = newBulkWriter(m.jobs(), cfg, m.log)
+	m.progress = newProgress(m.log, cfg.Quota)
+}
 
+// fork returns a Map for another pipeline run with cfg, sharing the store,
+// the http client and the rate limit of the api key.
+func (m *Map) fork(cfg *Config) *Map {
+	f := &Map{
+		restyClient:  m.restyClient,
+		log:          m.log,
+		ctx:          m.ctx,
+		interrupted:  m.interrupted,
+		calls:        m.calls,
+		mongoCli:     m.mongoCli,
+		logFields:    m.logFields,
+		owner:        m.owner,
+		limiter:      m.limiter,
+		localRouting: true,
+	}
+	f.setConfig(cfg)
+	return f
+}
+
+// saveEntity stores a new or changed person or office, unless it is a dry
+// run, which must leave the store as it is.
+func (m *Map) saveEntity(id primitive.ObjectID, entity interface{}) error {
+	if m.dryRun {
+		return nil
+	}
+	return m.entityWriter.UpsertId(m.ctx, id, entity)
+}
+
+// resetRoutes drops the durations of the entity whose address changed and
+// puts its jobs back to pending.
+func (m *Map) resetRoutes(filter bson.M, name string) {
+	if m.dryRun {
+		return
+	}
+	if err := m.removeDurations(filter); err != nil {
+		m.log.Errorf("Removing durations of %v fails, err: %v", name, err)
+	}
+	if err := m.resetJobs(filter); err != nil {
+		m.log.Errorf("Resetting jobs of %v fails, err: %v", name, err)
+	}
 }
 
-func (m *Map) getPoi(addr string) (Poi, error) {
-	path := fmt.Sprintf(place, url.QueryEscape(addr), url.QueryEscape(default_region))
-	sn := generateSN(path)
-	m.log.Debugf("path: %v sn: %s", path, sn)
-	urlPath := fmt.Sprintf(host+place+"&sn=%s", url.QueryEscape(addr), url.QueryEscape(default_region), sn)
-	resp, err := m.restyClient.R().EnableTrace().Get(urlPath)
+func (m *Map) getPoi(ctx context.Context, addr string) (Poi, error) {
+	m.progress.Call("")
+	path := fmt.Sprintf(place, url.QueryEscape(addr), url.QueryEscape(m.cfg.Region)) + m.cfg.AK
+	sn := generateSN(path, m.cfg.SK)
+	m.log.Debugf("Geocode %v", addr)
+	urlPath := host + path + "&sn=" + sn
+	start := time.Now()
+	resp, err := m.restyClient.R().SetContext(ctx).EnableTrace().Get(urlPath)
 	if err != nil {
-		m.log.Errorf("Get %v fails", urlPath)
+		observeRequest("place", start, "error")
+		err = redactError(err)
+		m.log.WithField("address", addr).Errorf("Geocoding %v fails, err: %v", addr, err)
 		return Poi{}, err
 	}
 	m.log.Debugf("Resp: %v", string(resp.Body()))
 	var placeResp PlaceResp
 	err = json.Unmarshal(resp.Body(), &placeResp)
 	if err != nil {
+		observeRequest("place", start, fmt.Sprintf("http_%d", resp.StatusCode()))
 		m.log.Errorf("Parse resp data fails, err: %v", err)
 		return Poi{}, err
 	}
+	observeRequest("place", start, strconv.Itoa(placeResp.Status))
 	m.log.Debugf("resp: %+v", placeResp)
 	if placeResp.Status != 0 || len(placeResp.Results) < 1 {
-		m.log.Errorf("Can not get poi from server, message: %v", placeResp.Message)
-		return Poi{}, fmt.Errorf("Can not get poi from server, message: %v", placeResp.Message)
+		m.log.WithFields(logrus.Fields{"address": addr, "baidu_status": placeResp.Status}).Errorf("Can not get poi from server, message: %v", placeResp.Message)
+		return Poi{}, &apiError{
+			Status:  placeResp.Status,
+			Message: placeResp.Message,
+			err:     fmt.Errorf("Can not get poi from server, message: %v", placeResp.Message),
+		}
 	}
 	return placeResp.Results[0].Location, nil
 }
 
-func (m *Map) getAllPoi() {
-	m.log.Infof("Get poi for address")
-	for index, person := range m.personSlice {
-		poi := m.personSlice[index].Poi
-		if IsEqual(poi.Lat, 0) && IsEqual(poi.Lng, 0) {
-			poi, err := m.getPoi(m.personSlice[index].Address)
-			if err != nil {
-				m.log.Errorf("Getting poi for %v fails, err: %v", person.Name, err)
-			}
-			m.personSlice[index].Poi = poi
-			_, err = m.mongoCli.UpsertId(m.ctx, person.Id, m.personSlice[index])
-			if err != nil {
-				m.log.Errorf("MongoDB updating fails for %v, err: %v", person.Name, err)
-			}
-		} else {
-			m.log.Debugf("Poi(%+v) exists for %v", m.personSlice[index].Poi, m.personSlice[index].Name)
-		}
-	}
-	for index, office := range m.officeSlice {
-		poi := m.officeSlice[index].Poi
-		if IsEqual(poi.Lat, 0) && IsEqual(poi.Lng, 0) {
-			poi, err := m.getPoi(m.officeSlice[index].Address)
-			if err != nil {
-				m.log.Errorf("Getting poi for %v fails, err: %v", office.Name, err)
-			}
-			m.officeSlice[index].Poi = poi
-			_, err = m.mongoCli.UpsertId(m.ctx, office.Id, m.officeSlice[index])
-			if err != nil {
-				m.log.Errorf("MongoDB updating fails for %v, err: %v", office.Name, err)
-			}
-		} else {
-			m.log.Debugf("Poi(%+v) exists for %v", m.officeSlice[index].Poi, m.officeSlice[index].Name)
-		}
-	}
+func (m *Map) calRoute(ctx context.Context, origin, dest Poi, path string) (Route, error) {
+	return m.calRouteAt(ctx, origin, dest, path, m.cfg.DepartAt)
 }
 
-func (m *Map) calDuration(origin, dest Poi) map[string]int {
-	r := make(map[string]int, len(path_type))
-	times, err := time.Parse(time_format, time_morning)
+// calRouteAt routes at the departure time of a job rather than the one of
+// this process.
+func (m *Map) calRouteAt(ctx context.Context, origin, dest Poi, path string, departAt string) (Route, error) {
+	m.progress.Call(path)
+	times, err := time.Parse(time_format, departAt)
 	if err != nil {
-		m.log.Errorf("Can not convert time: %v, err: %v", time_morning, err)
-		return nil
+		return Route{}, fmt.Errorf("Can not convert time: %v, err: %v", departAt, err)
 	}
 	timestamp := fmt.Sprintf("%d", times.Unix())
-	for _, path := range path_type {
-		r[path] = 0xffffffff
-		pathStr := fmt.Sprintf(path_map[path], fmt.Sprintf("%f", origin.Lat), fmt.Sprintf("%f", origin.Lng), fmt.Sprintf("%f", dest.Lat), fmt.Sprintf("%f", dest.Lng), timestamp)
-		m.log.Debug(pathStr)
-		sn := generateSN(pathStr)
-		urlPath := fmt.Sprintf(host+pathStr+"&sn=%s", sn)
-		resp, err := m.restyClient.R().EnableTrace().Get(urlPath)
-		if err != nil {
-			m.log.Errorf("Get %v fails", urlPath)
-			continue
-		}
-		var pathPlan PathPlan
-		err = json.Unmarshal(resp.Body(), &pathPlan)
-		if err != nil {
-			m.log.Errorf("Parse resp data fails, err: %v", err)
-			continue
-		}
-		if pathPlan.Status != 0 {
-			m.log.Errorf("Can not get path plan (%v) from server, status: %v, message: %v", path, pathPlan.Status, pathPlan.Message)
-			continue
+	pathStr := fmt.Sprintf(path_map[path], fmt.Sprintf("%f", origin.Lat), fmt.Sprintf("%f", origin.Lng), fmt.Sprintf("%f", dest.Lat), fmt.Sprintf("%f", dest.Lng), timestamp) + m.cfg.AK
+	m.log.Debugf("Route %v from %+v to %+v", path, origin, dest)
+	sn := generateSN(pathStr, m.cfg.SK)
+	urlPath := fmt.Sprintf(host+pathStr+"&sn=%s", sn)
+	start := time.Now()
+	resp, err := m.restyClient.R().SetContext(ctx).EnableTrace().Get(urlPath)
+	if err != nil {
+		observeRequest(path, start, "error")
+		return Route{}, redactError(err)
+	}
+	var pathPlan PathPlan
+	err = json.Unmarshal(resp.Body(), &pathPlan)
+	if err != nil {
+		observeRequest(path, start, fmt.Sprintf("http_%d", resp.StatusCode()))
+		return Route{}, fmt.Errorf("Parse resp data fails, err: %v", err)
+	}
+	observeRequest(path, start, strconv.Itoa(pathPlan.Status))
+	if pathPlan.Status != 0 || len(pathPlan.Result.Routes) < 1 {
+		return Route{}, &apiError{
+			Status:  pathPlan.Status,
+			Message: pathPlan.Message,
+			err:     fmt.Errorf("Can not get path plan (%v) from server, status: %v, message: %v", path, pathPlan.Status, pathPlan.Message),
 		}
-		r[path] = pathPlan.Result.Routes[0].Duration / 60
 	}
-	return r
+	return pathPlan.Result.Routes[0], nil
 }
 
-func (m *Map) calDurationForAllOffices(person *Person) {
-	for _, office := range m.officeSlice {
-		m.log.Debugf("person : %v, office: %v, done: %v", person.Name, office.Name, person.Done)
-		duration := m.calDuration(person.Poi, office.Poi)
-		if duration == nil {
+// aggregateRoutes is the only consumer of the route results. It saves every
+// duration and commits the finished jobs to the ledger batch by batch.
+func (m *Map) aggregateRoutes(results <-chan RouteResult, cancel context.CancelFunc) error {
+	var r error
+	finished := []RouteResult{}
+	for result := range results {
+		job := result.Job
+		if r != nil {
 			continue
 		}
-		d := Duration{
-			DurationPath: duration,
-		}
-		d.Sort = func(d map[string]int, canDrive bool) []string {
-			values := []int{}
-			for k, v := range d {
-				if !canDrive && k == "drive" {
-					continue
-				}
-				values = append(values, v)
+		if isReleased(result.Err) {
+			m.log.WithFields(routeFields(job, nil)).Debugf("Routing %v is released", job.Mode)
+		} else if result.Err != nil {
+			m.progress.Add(job.Mode, result.Err)
+			m.log.WithFields(routeFields(job, result.Err)).Errorf("Routing %v fails, err: %v", job.Mode, result.Err)
+		} else {
+			m.progress.Add(job.Mode, nil)
+			err := m.saveDuration(PairDuration{
+				PersonId:   job.PersonId,
+				OfficeId:   job.OfficeId,
+				Mode:       job.Mode,
+				DepartAt:   job.DepartAt,
+				Seconds:    result.Route.Duration,
+				Metres:     result.Route.Distance,
+				ComputedAt: time.Now(),
+			})
+			if err != nil {
+				r = err
+				cancel()
+				continue
 			}
-			sort.Ints(values)
-			r := []string{}
-			for _, v := range values {
-				for path, duration := range d {
-					if !canDrive && path == "drive" {
-						continue
-					}
-					if v == duration {
-						r = append(r, path)
-					}
-				}
+		}
+		finished = append(finished, result)
+		if len(finished) >= m.cfg.BulkSize {
+			r = m.commitJobs(finished)
+			finished = finished[:0]
+			if r != nil {
+				cancel()
 			}
-			return r
-		}(d.DurationPath, person.CanDrive)
-		if !person.CanDrive {
-			d.Sort = append(d.Sort, "drive")
 		}
-		person.DurationMap[office.Name] = d
 	}
-	_, err := m.mongoCli.UpsertId(m.ctx, person.Id, person)
-	if err != nil {
-		m.log.Errorf("MongoDB updating fails for %v, err: %v", person.Name, err)
+	if r != nil {
+		return r
 	}
-	person.Done = true
-	m.lock.Lock()
-	m.currentWorker--
-	m.wg.Done()
-	m.lock.Unlock()
+	return m.commitJobs(finished)
 }
 
-func (m *Map) getAllDuration() {
+func (m *Map) getAllDuration() error {
 	m.log.Infof("Get duration from person to office")
-	for index := range m.personSlice {
-		if m.personSlice[index].Done {
-			m.log.Debugf("%v has done", m.personSlice[index].Name)
-			continue
-		}
-		for {
-			m.lock.Lock()
-			if m.currentWorker < max_workers {
-				m.log.Debugf("Current Workers: %d", m.currentWorker)
-				m.wg.Add(1)
-				go m.calDurationForAllOffices(&m.personSlice[index])
-				m.currentWorker++
-				m.lock.Unlock()
-				break
-			} else {
-				m.lock.Unlock()
-				time.Sleep(5 * time.Second)
-			}
+	if err := m.ensureDurationIndexes(); err != nil {
+		m.log.Errorf("Creating duration indexes fails, err: %v", err)
+	}
+	if err := m.ensureJobIndexes(); err != nil {
+		m.log.Errorf("Creating job indexes fails, err: %v", err)
+	}
+	if err := m.syncJobs(); err != nil {
+		return err
+	}
+	totals, err := m.unfinishedByMode(m.workbookFilter())
+	if err != nil {
+		m.log.Errorf("Counting routes fails, err: %v", err)
+	}
+	if synced, err := m.jobs().Find(m.ctx, m.workbookFilter()).Count(); err == nil {
+		misses := 0
+		for _, n := range totals {
+			misses += n
 		}
+		metrics.cache.Add(float64(int(synced)-misses), "route", "hit")
+		metrics.cache.Add(float64(misses), "route", "miss")
 	}
-	m.wg.Wait()
+	m.progress.Start(stage_route, totals)
+	err = m.waitForJobs(m.workbookFilter())
+	m.progress.End()
+	if err != nil {
+		return err
+	}
+	return m.flushWriters()
 }
+
+func (m *Map) officeNames() map[primitive.ObjectID]string {
+	r := make(map[primitive.ObjectID]string, len(m.officeSlice))
+	for _, o := range m.officeSlice {
+		r[o.Id] = o.Name
+	}
+	return r
+}
+
+func (m *Map) personNames() map[primitive.ObjectID]string {
+	r := make(map[primitive.ObjectID]string, len(m.personSlice))
+	for _, p := range m.personSlice {
+		r[p.Id] = p.Name
+	}
+	return r
+}
+
 func (m *Map) findOffices() {
 	m.log.Infof("Calculate duration to find nearest offices for a person")
+	names := m.officeNames()
 	for index := range m.personSlice {
-		m.personSlice[index].designate()
-		_, err := m.mongoCli.UpsertId(m.ctx, m.personSlice[index].Id, m.personSlice[index])
+		ranked, err := m.rankOffices(&m.personSlice[index], nearest_offices)
 		if err != nil {
-			m.log.Errorf("MongoDB updating fails for %v, err: %v", m.personSlice[index].Name, err)
+			m.log.WithField("person_id", m.personSlice[index].Id.Hex()).Errorf("Ranking offices fails for %v, err: %v", m.personSlice[index].Name, err)
+			continue
 		}
+		m.personSlice[index].designate(ranked, names)
 	}
 }
 
-func (p *Person) designate() {
-	for k, v := range p.DurationMap {
-		if len(v.Sort) == 0 {
-			continue
-		}
-		d := v.DurationPath[v.Sort[0]]
-		p.SortMap[d] = append(p.SortMap[d], DesignateOffice{
-			Path: v.Sort[0],
-			Name: k,
-		})
-		p.SortList = append(p.SortList, d)
-	}
-	sort.Ints(p.SortList)
-	done := false
-	for i := 0; i < nearest_offices; {
-		for j := range p.SortMap[p.SortList[i]] {
-			p.NearestOffices[i] = p.SortMap[p.SortList[i]][j].Name
-			p.NearestDurations[i] = p.SortList[i]
-			i++
-			if i >= nearest_offices {
-				done = true
-				break
-			}
-		}
-		if done {
-			break
-		}
+func (p *Person) designate(ranked []RankedPair, names map[primitive.ObjectID]string) {
+	p.NearestOffices = [nearest_offices]string{}
+	p.NearestDurations = [nearest_offices]int{}
+	for i := 0; i < nearest_offices && i < len(ranked); i++ {
+		p.NearestOffices[i] = names[ranked[i].Id]
+		p.NearestDurations[i] = ranked[i].Seconds / 60
 	}
 }
 
 func (m *Map) findPersons() {
 	m.log.Infof("Calculate duration to find nearest persons for an office")
+	names := m.personNames()
 	for index, office := range m.officeSlice {
-		for _, person := range m.personSlice {
-			duration := person.DurationMap[office.Name]
-			if len(duration.Sort) == 0 {
-				continue
-			}
-			path := duration.Sort[0]
-			d := duration.DurationPath[path]
-			m.officeSlice[index].SortMap[d] = append(m.officeSlice[index].SortMap[d], Dummy{
-				PersonName: person.Name,
-				Path:       path,
-				Duration:   d,
-			})
-		}
-		keys := []int{}
-		for key := range m.officeSlice[index].SortMap {
-			keys = append(keys, key)
-		}
-		sort.Ints(keys)
-		for _, key := range keys {
-			for i := range m.officeSlice[index].SortMap[key] {
-				m.officeSlice[index].SortList = append(m.officeSlice[index].SortList, m.officeSlice[index].SortMap[key][i])
-			}
-		}
-		_, err := m.mongoCli.UpsertId(m.ctx, office.Id, m.officeSlice[index])
+		ranked, err := m.rankPersons(&m.officeSlice[index], 0)
 		if err != nil {
-			m.log.Errorf("MongoDB updating fails for %v, err: %v", office.Name, err)
+			m.log.WithField("office_id", office.Id.Hex()).Errorf("Ranking persons fails for %v, err: %v", office.Name, err)
+			continue
 		}
+		m.officeSlice[index].SortList = []Dummy{}
+		for _, r := range ranked {
+			m.officeSlice[index].SortList = append(m.officeSlice[index].SortList, Dummy{
+				PersonName: names[r.Id],
+				Path:       r.Mode,
+				Duration:   r.Seconds / 60,
+			})
+		}
+	}
+}
 
+// stopRun ends a run that failed or was interrupted. An interrupted run may
+// still write what it has to a partial workbook.
+func (m *Map) stopRun(err error) error {
+	if err != errInterrupted {
+		return m.failRun(err)
+	}
+	m.finishRun(run_status_interrupted)
+	if m.cfg.Partial {
+		m.findOffices()
+		m.findPersons()
+		if perr := m.writePartialExcel(); perr != nil {
+			m.log.Errorf("Writing partial workbook fails, err: %v", perr)
+		}
 	}
+	return err
+}
+
+// writePartialExcel writes the results of an interrupted run next to the
+// workbook, with a note on top of the result columns.
+func (m *Map) writePartialExcel() error {
+	file := strings.TrimSuffix(m.cfg.ExcelFile, filepath.Ext(m.cfg.ExcelFile)) + ".partial" + filepath.Ext(m.cfg.ExcelFile)
+	note := "INCOMPLETE: run interrupted at " + time.Now().Format(time_format) + ", results are partial"
+	m.fillExcel()
+	m.excelFile.SetCellStr(sheet_person, string(rune(sheet_person_result_start))+"1", note)
+	m.excelFile.SetCellStr(sheet_office, string(rune(sheet_office_result_start))+"1", note)
+	m.log.Warnf("Write partial result to %v", file)
+	return m.excelFile.SaveAs(file)
 }
 
 func (m *Map) writeToExcel() {
 	defer m.excelFile.Save()
 
 	m.log.Infof("Write result to excel file")
+	m.fillExcel()
+}
+
+func (m *Map) fillExcel() {
 	for index := range m.personSlice {
 		for i := 0; i < nearest_offices; i++ {
-			m.excelFile.SetCellStr(sheet_person, string(sheet_person_result_start+i)+strconv.Itoa(index+2), m.personSlice[index].NearestOffices[i]+" ("+strconv.Itoa(m.personSlice[index].NearestDurations[i])+")")
+			m.excelFile.SetCellStr(sheet_person, string(rune(sheet_person_result_start+i))+strconv.Itoa(index+2), m.personSlice[index].NearestOffices[i]+" ("+strconv.Itoa(m.personSlice[index].NearestDurations[i])+")")
 		}
 	}
 
 	for index := range m.officeSlice {
-		for i := 0; i < nearest_persons; i++ {
-			m.excelFile.SetCellStr(sheet_office, string(sheet_office_result_start+i)+strconv.Itoa(index+2), m.officeSlice[index].SortList[i].PersonName+" ("+strconv.Itoa(m.officeSlice[index].SortList[i].Duration)+")")
+		for i := 0; i < nearest_persons && i < len(m.officeSlice[index].SortList); i++ {
+			m.excelFile.SetCellStr(sheet_office, string(rune(sheet_office_result_start+i))+strconv.Itoa(index+2), m.officeSlice[index].SortList[i].PersonName+" ("+strconv.Itoa(m.officeSlice[index].SortList[i].Duration)+")")
 		}
 	}
+	if m.cfg.Assign {
+		m.fillAssignment()
+		m.fillObjectives(m.objectiveStats)
+	}
+	if m.cfg.Rebalance {
+		m.fillRebalance()
+	}
+	if m.cfg.Reach {
+		m.fillReach()
+	}
 }
 
 func (p *Person) showDesignate() {
 	fmt.Printf("Person Name: %v\n", p.Name)
-	for i := range p.SortList {
+	for i := range p.NearestOffices {
 		fmt.Printf("\tThe nearest office: %v\n", p.NearestOffices[i])
 		fmt.Printf("\t\tDuration: %v\n", p.NearestDurations[i])
 	}
@@ -576,30 +701,179 @@ func (m *Map) showDesignateAll() {
 	}
 }
 
+func (m *Map) runPipeline() error {
+	if err := m.startRun(); err != nil {
+		return err
+	}
+	m.logFields.setStage(stage_load)
+	m.log.Infof("Load data from excel file")
+	if err := m.loadExecelData(m.cfg.ExcelFile); err != nil {
+		return m.failRun(err)
+	}
+	m.logFields.setStage(stage_geocode)
+	if err := m.getAllPoi(); err != nil {
+		return m.stopRun(err)
+	}
+	m.logFields.setStage(stage_route)
+	if err := m.getAllDuration(); err != nil {
+		return m.stopRun(err)
+	}
+	m.logFields.setStage(stage_rank)
+	m.findOffices()
+	m.findPersons()
+	if m.cfg.Assign {
+		m.logFields.setStage(stage_assign)
+		if err := m.assignOffices(); err != nil {
+			return m.failRun(err)
+		}
+	}
+	if m.cfg.Reach {
+		m.logFields.setStage(stage_reach)
+		if err := m.reachability(); err != nil {
+			return m.failRun(err)
+		}
+	}
+	if m.cfg.Rebalance {
+		m.logFields.setStage(stage_rebalance)
+		if err := m.rebalance(); err != nil {
+			return m.failRun(err)
+		}
+	}
+	if err := m.saveSnapshot(); err != nil {
+		return m.failRun(err)
+	}
+	m.logFields.setStage(stage_excel)
+	m.writeToExcel()
+	m.finishRun(run_status_done)
+
+	//	m.showDesignateAll()
+	//	m.showPerson()
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [flags] [args]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "\trun\t\t\trun the whole pipeline (default)\n")
+	fmt.Fprintf(os.Stderr, "\tcoordinate\t\trun the pipeline, leaving the routing to workers\n")
+	fmt.Fprintf(os.Stderr, "\tplan\t\t\testimate the api calls, quota and time of a run without making them\n")
+	fmt.Fprintf(os.Stderr, "\tworker\t\t\troute the jobs of any coordinator with its own key\n")
+	fmt.Fprintf(os.Stderr, "\tserve\t\t\trun uploaded workbooks through an http api\n")
+	fmt.Fprintf(os.Stderr, "\tquery <address|lat,lng>\trank the offices for an address outside the workbook\n")
+	fmt.Fprintf(os.Stderr, "\tscenario <file.json>\tcompare the workbook with offices added, removed or moved\n")
+	fmt.Fprintf(os.Stderr, "\tsites\t\t\tchoose the best sites of the candidates sheet\n")
+	fmt.Fprintf(os.Stderr, "\tsuggest\t\t\tcluster where persons live and search for sites near the clusters\n")
+	fmt.Fprintf(os.Stderr, "\tisochrones [office...]\twrite the areas reaching the offices within the thresholds as geojson\n")
+	fmt.Fprintf(os.Stderr, "\truns\t\t\tlist the recorded runs\n")
+	fmt.Fprintf(os.Stderr, "\tresume\t\t\tprint the routes of the workbook left by an interrupted run\n")
+	fmt.Fprintf(os.Stderr, "\tdiff <runA> <runB>\tlist persons whose top office or commute changed\n")
+}
+
 func main() {
 	logger := logrus.StandardLogger()
-	ctx := context.Background()
-	cli, err := qmgo.Open(ctx, &qmgo.Config{Uri: mongo_url, Database: mongo_database, Coll: mongo_collection})
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fs.PrintDefaults()
+	}
+	cfg := newConfig(fs)
+	fs.Parse(args)
+	fields := &logFields{}
+	if err := setupLogger(logger, cfg, fields); err != nil {
+		logger.Errorf("Setting up the log fails, err: %v", err)
+		os.Exit(2)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupted, stopScheduling := context.WithCancel(ctx)
+	defer stopScheduling()
+	calls, cancelCalls := context.WithCancel(ctx)
+	defer cancelCalls()
+	cli, err := qmgo.Open(ctx, &qmgo.Config{Uri: cfg.MongoURL, Database: cfg.Database, Coll: cfg.Collection})
 	if err != nil {
 		logger.Errorf("Opening mongo cli fails, err: %v", err)
 		os.Exit(1)
 	}
 	defer cli.Close(ctx)
-	m := Map{
+	m := &Map{
 		restyClient: resty.New(),
 		log:         logger,
 		ctx:         ctx,
+		interrupted: interrupted,
+		calls:       calls,
 		mongoCli:    cli,
-		lock:        &sync.Mutex{},
+		logFields:   fields,
+		owner:       processOwner(),
+		limiter:     newLimiter(cfg.QPS),
+	}
+	m.setConfig(cfg)
+	m.localRouting = command != "coordinate"
+	if cfg.DryRun && (command == "run" || command == "coordinate") {
+		command = "plan"
+	}
+	m.dryRun = command == "plan"
+	go m.handleSignals(stopScheduling, cancelCalls, cancel)
+	if cfg.MetricsAddr != "" {
+		go m.serveMetrics(ctx, cfg.MetricsAddr)
+	}
+	switch command {
+	case "run", "coordinate":
+		err = m.runPipeline()
+	case "plan":
+		err = m.showPlan()
+	case "worker":
+		err = m.runWorker()
+	case "serve":
+		err = m.serve()
+	case "query":
+		if fs.NArg() == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = m.showQuery(strings.Join(fs.Args(), " "))
+	case "scenario":
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = m.runScenario(fs.Arg(0))
+	case "sites":
+		err = m.chooseSites()
+	case "suggest":
+		err = m.suggestSites()
+	case "isochrones":
+		err = m.isochrones(fs.Args())
+	case "runs":
+		err = m.listRuns()
+	case "resume":
+		err = m.showResume()
+	case "diff":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		err = m.showDiff(fs.Arg(0), fs.Arg(1))
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	if ferr := m.flushWriters(); err == nil {
+		err = ferr
+	}
+	if cfg.PushGateway != "" {
+		if perr := m.pushMetrics(cfg.PushGateway); perr != nil {
+			logger.Errorf("Pushing metrics to %v fails, err: %v", cfg.PushGateway, perr)
+		}
+	}
+	if err != nil {
+		logger.Errorf("%v fails, err: %v", command, err)
+		cli.Close(ctx)
+		os.Exit(1)
 	}
-	logger.Infof("Load data from excel file")
-	m.loadExecelData(execel_file)
-	m.getAllPoi()
-	m.getAllDuration()
-	m.findOffices()
-	m.findPersons()
-	m.writeToExcel()
-
-	//	m.showDesignateAll()
-	//	m.showPerson()
 }
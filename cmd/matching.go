@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	objective_stable = "stable"
+	sheet_priorities = "priorities" // office name, then persons by priority
+	sheet_matching   = "matching"
+)
+
+// Preferences ranks offices for every person and persons for every office,
+// by index into the workbook slices.
+type Preferences struct {
+	Persons [][]int // offices in order of preference, acceptable ones only
+	Offices [][]int // persons in order of priority
+	Stated  []bool  // the person gave preferences in the workbook
+	// priority[j][i] is the position of person i for office j
+	priority [][]int
+}
+
+// MatchingReport tells how an assignment fits the preferences.
+type MatchingReport struct {
+	FirstChoice int `bson:"first_choice" json:"first_choice"` // persons at their first choice
+	Unstable    int `bson:"unstable" json:"unstable"`         // persons in a blocking pair
+	Stated      int `bson:"stated" json:"stated"`             // persons with preferences of their own
+}
+
+// readSeniority reads the seniority column of a person row, empty for 0.
+func readSeniority(row []string) (float64, error) {
+	if len(row) <= sheet_person_seniority_index {
+		return 0, nil
+	}
+	cell := strings.TrimSpace(row[sheet_person_seniority_index])
+	if cell == "" {
+		return 0, nil
+	}
+	seniority, err := strconv.ParseFloat(cell, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", cell)
+	}
+	return seniority, nil
+}
+
+// readPreferences reads the preference columns of a person row.
+func readPreferences(row []string) []string {
+	r := []string{}
+	for k := int(sheet_person_preference_index); k < len(row); k++ {
+		if cell := strings.TrimSpace(row[k]); cell != "" {
+			r = append(r, cell)
+		}
+	}
+	return r
+}
+
+// stated tells if some person gave preferences.
+func (p *Preferences) stated() bool {
+	for _, s := range p.Stated {
+		if s {
+			return true
+		}
+	}
+	return false
+}
+
+// readRanking reads a sheet of name, then ranked names, into indexes.
+// Unknown names are logged and skipped, a missing sheet gives nothing.
+func (m *Map) readRanking(sheet string, owners, ranked map[string]int) map[int][]int {
+	r := map[int][]int{}
+	if m.excelFile.GetSheetIndex(sheet) < 0 {
+		return r
+	}
+	rows, err := m.excelFile.GetRows(sheet)
+	if err != nil {
+		m.log.Errorf("Reading %v fails, err: %v", sheet, err)
+		return r
+	}
+	for index, row := range rows {
+		if index == 0 || len(row) == 0 {
+			continue
+		}
+		owner, ok := owners[strings.TrimSpace(row[0])]
+		if !ok {
+			m.log.Warnf("Unknown %v in %v row %d", row[0], sheet, index+1)
+			continue
+		}
+		seen := map[int]bool{}
+		for _, cell := range row[1:] {
+			name := strings.TrimSpace(cell)
+			if name == "" {
+				continue
+			}
+			k, ok := ranked[name]
+			if !ok {
+				m.log.Warnf("Unknown %v in %v row %d", name, sheet, index+1)
+				continue
+			}
+			if !seen[k] {
+				seen[k] = true
+				r[owner] = append(r[owner], k)
+			}
+		}
+	}
+	return r
+}
+
+// loadPreferences reads the preference columns and the seniority of the
+// persons, and the priorities sheet for offices ranking persons their own
+// way. Persons without preferences rank the offices by commute, and stated
+// lists go on with the offices they left out in the same order. Offices a
+// person has no route to are only acceptable when stated. Offices rank the
+// persons they do not list by seniority, then by their SortList, then the
+// persons without a route by name.
+func (m *Map) loadPreferences(costs *Costs) *Preferences {
+	personIndex := make(map[string]int, len(m.personSlice))
+	for i, p := range m.personSlice {
+		personIndex[p.Name] = i
+	}
+	officeIndex := make(map[string]int, len(m.officeSlice))
+	for j, o := range m.officeSlice {
+		officeIndex[o.Name] = j
+	}
+	stated := map[int][]int{}
+	for i, person := range m.personSlice {
+		seen := map[int]bool{}
+		for _, name := range person.Preferences {
+			j, ok := officeIndex[name]
+			if !ok {
+				m.log.Warnf("Unknown office %v in the preferences of %v", name, person.Name)
+				continue
+			}
+			if !seen[j] {
+				seen[j] = true
+				stated[i] = append(stated[i], j)
+			}
+		}
+	}
+	priorities := m.readRanking(sheet_priorities, officeIndex, personIndex)
+
+	p := &Preferences{
+		Persons:  make([][]int, len(m.personSlice)),
+		Offices:  make([][]int, len(m.officeSlice)),
+		Stated:   make([]bool, len(m.personSlice)),
+		priority: make([][]int, len(m.officeSlice)),
+	}
+	for i := range m.personSlice {
+		listed := map[int]bool{}
+		for _, j := range stated[i] {
+			if costs.Seconds[i][j] == no_route {
+				m.log.Warnf("No route from %v to %v, the preference is kept", m.personSlice[i].Name, m.officeSlice[j].Name)
+			}
+			listed[j] = true
+			p.Persons[i] = append(p.Persons[i], j)
+		}
+		p.Stated[i] = len(stated[i]) > 0
+		rest := []int{}
+		for j, s := range costs.Seconds[i] {
+			if s != no_route && !listed[j] {
+				rest = append(rest, j)
+			}
+		}
+		sort.Slice(rest, func(a, b int) bool { return costs.rank(i, rest[a]) < costs.rank(i, rest[b]) })
+		p.Persons[i] = append(p.Persons[i], rest...)
+	}
+	for j, o := range m.officeSlice {
+		listed := map[int]bool{}
+		for _, i := range priorities[j] {
+			listed[i] = true
+			p.Offices[j] = append(p.Offices[j], i)
+		}
+		// persons without a route rank last
+		position := make([]int, len(m.personSlice))
+		for i := range position {
+			position[i] = len(m.personSlice)
+		}
+		for k, d := range o.SortList {
+			if i, ok := personIndex[d.PersonName]; ok && position[i] == len(m.personSlice) {
+				position[i] = k
+			}
+		}
+		rest := []int{}
+		for i := range m.personSlice {
+			if !listed[i] {
+				rest = append(rest, i)
+			}
+		}
+		sort.Slice(rest, func(a, b int) bool {
+			pa, pb := &m.personSlice[rest[a]], &m.personSlice[rest[b]]
+			if pa.Seniority != pb.Seniority {
+				return pa.Seniority > pb.Seniority
+			}
+			if position[rest[a]] != position[rest[b]] {
+				return position[rest[a]] < position[rest[b]]
+			}
+			return pa.Name < pb.Name
+		})
+		p.Offices[j] = append(p.Offices[j], rest...)
+		p.priority[j] = make([]int, len(m.personSlice))
+		for k, i := range p.Offices[j] {
+			p.priority[j][i] = k
+		}
+	}
+	return p
+}
+
+// solveStable matches persons to offices by deferred acceptance: persons
+// propose in order of preference and offices keep the persons they rank
+// highest within their capacity. The matching is stable and the best
+// stable one for every person. Pairs not allowed are never proposed.
+func solveStable(prefs *Preferences, capacity []int, allowed func(i, j int) bool) []int {
+	r := make([]int, len(prefs.Persons))
+	next := make([]int, len(prefs.Persons))
+	held := make([][]int, len(capacity))
+	free := []int{}
+	for i := range r {
+		r[i] = unassigned
+		free = append(free, i)
+	}
+	for len(free) > 0 {
+		i := free[len(free)-1]
+		free = free[:len(free)-1]
+		if next[i] >= len(prefs.Persons[i]) {
+			continue
+		}
+		j := prefs.Persons[i][next[i]]
+		next[i]++
+		if capacity[j] <= 0 || (allowed != nil && !allowed(i, j)) {
+			free = append(free, i)
+			continue
+		}
+		if len(held[j]) < capacity[j] {
+			held[j] = append(held[j], i)
+			r[i] = j
+			continue
+		}
+		// replace the lowest ranked person held, if i ranks higher
+		worst := 0
+		for k := range held[j] {
+			if prefs.priority[j][held[j][k]] > prefs.priority[j][held[j][worst]] {
+				worst = k
+			}
+		}
+		if prefs.priority[j][i] < prefs.priority[j][held[j][worst]] {
+			rejected := held[j][worst]
+			held[j][worst] = i
+			r[i], r[rejected] = j, unassigned
+			free = append(free, rejected)
+		} else {
+			free = append(free, i)
+		}
+	}
+	return r
+}
+
+// choice returns the position of office j in the preferences of person i,
+// starting at 1, or 0 when j is not acceptable.
+func (p *Preferences) choice(i, j int) int {
+	for k, o := range p.Persons[i] {
+		if o == j {
+			return k + 1
+		}
+	}
+	return 0
+}
+
+// blocking returns the offices person i prefers to its assignment that
+// have room or hold a person they rank lower.
+func (p *Preferences) blocking(i int, assigned, capacity []int) []int {
+	r := []int{}
+	for _, j := range p.Persons[i] {
+		if j == assigned[i] {
+			break
+		}
+		held := 0
+		block := false
+		for k, o := range assigned {
+			if o != j {
+				continue
+			}
+			held++
+			if p.priority[j][i] < p.priority[j][k] {
+				block = true
+			}
+		}
+		if block || held < capacity[j] {
+			r = append(r, j)
+		}
+	}
+	return r
+}
+
+// reportMatching checks an assignment against the preferences, prints who
+// got the first choice and the unstable assignments, and writes both to the
+// matching sheet.
+func (m *Map) reportMatching(prefs *Preferences, assigned, capacity []int) MatchingReport {
+	report := MatchingReport{}
+	m.excelFile.DeleteSheet(sheet_matching)
+	m.excelFile.NewSheet(sheet_matching)
+	header := []interface{}{"person", "assigned office", "choice", "first choice", "stated", "blocking offices"}
+	m.excelFile.SetSheetRow(sheet_matching, "A1", &header)
+	unstable := []string{}
+	for i, p := range m.personSlice {
+		office, choice, first := "", 0, false
+		if j := assigned[i]; j != unassigned {
+			office, choice = m.officeSlice[j].Name, prefs.choice(i, j)
+			first = choice == 1
+		}
+		if first {
+			report.FirstChoice++
+		}
+		if prefs.Stated[i] {
+			report.Stated++
+		}
+		names := []string{}
+		for _, j := range prefs.blocking(i, assigned, capacity) {
+			names = append(names, m.officeSlice[j].Name)
+		}
+		if len(names) > 0 {
+			report.Unstable++
+			unstable = append(unstable, fmt.Sprintf("%v at %v prefers %v", p.Name, office, strings.Join(names, ", ")))
+		}
+		row := []interface{}{p.Name, office, choice, first, prefs.Stated[i], strings.Join(names, ", ")}
+		m.excelFile.SetSheetRow(sheet_matching, "A"+strconv.Itoa(i+2), &row)
+	}
+	fmt.Fprintf(os.Stdout, "%d of %d persons at their first choice, %d stated preferences, %d unstable assignments\n",
+		report.FirstChoice, len(m.personSlice), report.Stated, report.Unstable)
+	for _, u := range unstable {
+		fmt.Fprintf(os.Stdout, "  unstable: %v\n", u)
+	}
+	return report
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newPreferences builds preferences from the rankings of both sides.
+func newPreferences(persons, offices [][]int) *Preferences {
+	p := &Preferences{Persons: persons, Offices: offices, Stated: make([]bool, len(persons))}
+	p.priority = make([][]int, len(offices))
+	for j, ranked := range offices {
+		p.priority[j] = make([]int, len(persons))
+		for k, i := range ranked {
+			p.priority[j][i] = k
+		}
+	}
+	return p
+}
+
+func TestSolveStable(t *testing.T) {
+	tests := []struct {
+		name     string
+		persons  [][]int
+		offices  [][]int
+		capacity []int
+		allowed  func(i, j int) bool
+		want     []int
+	}{
+		{"office priority", [][]int{{0, 1}, {0, 1}}, [][]int{{1, 0}, {0, 1}}, []int{1, 1}, nil, []int{1, 0}},
+		{"capacity", [][]int{{0, 1}, {0, 1}}, [][]int{{1, 0}, {0, 1}}, []int{2, 1}, nil, []int{0, 0}},
+		{"person proposes", [][]int{{0, 1}, {1, 0}}, [][]int{{1, 0}, {0, 1}}, []int{1, 1}, nil, []int{0, 1}},
+		{"unacceptable", [][]int{{0, 1}, {0}}, [][]int{{0, 1}, {0, 1}}, []int{1, 1}, nil, []int{0, unassigned}},
+		{"not allowed", [][]int{{0, 1}, {0, 1}}, [][]int{{1, 0}, {0, 1}}, []int{1, 1},
+			func(i, j int) bool { return !(i == 1 && j == 0) }, []int{0, 1}},
+		{"no capacity", [][]int{{0}, {0}}, [][]int{{0, 1}}, []int{0}, nil, []int{unassigned, unassigned}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefs := newPreferences(tt.persons, tt.offices)
+			got := solveStable(prefs, tt.capacity, tt.allowed)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("solveStable() = %v, want %v", got, tt.want)
+			}
+			if tt.allowed != nil {
+				return
+			}
+			for i := range got {
+				if blocking := prefs.blocking(i, got, tt.capacity); len(blocking) > 0 {
+					t.Errorf("person %v blocks with offices %v", i, blocking)
+				}
+			}
+		})
+	}
+}
+
+func TestReadSeniority(t *testing.T) {
+	row := make([]string, sheet_person_preference_index+2)
+	row[sheet_person_seniority_index] = " 2.5 "
+	row[sheet_person_preference_index] = "east"
+	row[sheet_person_preference_index+1] = " west "
+	if got, err := readSeniority(row); got != 2.5 || err != nil {
+		t.Errorf("readSeniority() = %v, %v, want 2.5", got, err)
+	}
+	if got := readPreferences(row); !reflect.DeepEqual(got, []string{"east", "west"}) {
+		t.Errorf("readPreferences() = %v, want [east west]", got)
+	}
+	row[sheet_person_seniority_index] = "senior"
+	if _, err := readSeniority(row); err == nil {
+		t.Errorf("readSeniority() of %q gives no error", row[sheet_person_seniority_index])
+	}
+	if got, err := readSeniority(row[:sheet_person_seniority_index]); got != 0 || err != nil {
+		t.Errorf("readSeniority() of a short row = %v, %v, want 0", got, err)
+	}
+}
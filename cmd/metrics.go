@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metrics_namespace = "baidu_map"
+	pushgateway_job   = "baidu_map"
+	metrics_content   = "text/plain; version=0.0.4"
+)
+
+var latency_buckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricVec is a counter, gauge or histogram with labels, written in the
+// prometheus text format. The client library is not vendored, and the few
+// metrics of the tool do not need it.
+type metricVec struct {
+	lock    sync.Mutex
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	buckets []float64
+	values  map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64 // counter or gauge value, sum of a histogram
+	count  uint64
+	counts []uint64 // per bucket, not cumulative
+}
+
+// Metrics are the metrics of the tool.
+type Metrics struct {
+	requests    *metricVec
+	latency     *metricVec
+	retries     *metricVec
+	cache       *metricVec
+	writeErrors *metricVec
+	poolWorkers *metricVec
+	poolBusy    *metricVec
+	poolTasks   *metricVec
+	all         []*metricVec
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		requests:    newMetricVec("baidu_requests_total", "Baidu api requests by api and status.", "counter", "api", "status"),
+		latency:     newMetricVec("baidu_request_duration_seconds", "Latency of baidu api requests.", "histogram", "api"),
+		retries:     newMetricVec("mongo_write_retries_total", "Retried bulk writes by collection.", "counter", "collection"),
+		cache:       newMetricVec("cache_lookups_total", "Geocode and route cache lookups by result.", "counter", "cache", "result"),
+		writeErrors: newMetricVec("mongo_write_errors_total", "Failed bulk writes by collection.", "counter", "collection"),
+		poolWorkers: newMetricVec("pool_workers", "Workers of the running pool.", "gauge"),
+		poolBusy:    newMetricVec("pool_busy_workers", "Workers of the running pool that run a task.", "gauge"),
+		poolTasks:   newMetricVec("pool_tasks_total", "Tasks run by the pools.", "counter"),
+	}
+	m.latency.buckets = latency_buckets
+	m.all = []*metricVec{m.requests, m.latency, m.retries, m.cache, m.writeErrors, m.poolWorkers, m.poolBusy, m.poolTasks}
+	return m
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   metrics_namespace + "_" + name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]*metricValue{},
+	}
+}
+
+func (v *metricVec) get(labels []string) *metricValue {
+	key := strings.Join(labels, "\xff")
+	mv := v.values[key]
+	if mv == nil {
+		mv = &metricValue{labels: labels, counts: make([]uint64, len(v.buckets))}
+		v.values[key] = mv
+	}
+	return mv
+}
+
+// Add adds delta to the counter or gauge with the given label values.
+func (v *metricVec) Add(delta float64, labels ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(labels).value += delta
+}
+
+// Set sets the gauge with the given label values.
+func (v *metricVec) Set(value float64, labels ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(labels).value = value
+}
+
+// Observe records one sample of the histogram.
+func (v *metricVec) Observe(value float64, labels ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	mv := v.get(labels)
+	mv.value += value
+	mv.count++
+	for i, b := range v.buckets {
+		if value <= b {
+			mv.counts[i]++
+			break
+		}
+	}
+}
+
+func labelPairs(names, values []string, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", name, values[i]))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *metricVec) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", v.name, v.help, v.name, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		mv := v.values[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", v.name, labelPairs(v.labels, mv.labels), mv.value)
+			continue
+		}
+		cumulative := uint64(0)
+		for i, b := range v.buckets {
+			cumulative += mv.counts[i]
+			fmt.Fprintf(w, "%v_bucket%v %d\n", v.name, labelPairs(v.labels, mv.labels, "le", fmt.Sprint(b)), cumulative)
+		}
+		fmt.Fprintf(w, "%v_bucket%v %d\n", v.name, labelPairs(v.labels, mv.labels, "le", "+Inf"), mv.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", v.name, labelPairs(v.labels, mv.labels), mv.value)
+		fmt.Fprintf(w, "%v_count%v %d\n", v.name, labelPairs(v.labels, mv.labels), mv.count)
+	}
+}
+
+// Write writes every metric in the prometheus text format.
+func (m *Metrics) Write(w io.Writer) {
+	for _, v := range m.all {
+		v.write(w)
+	}
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics_content)
+	m.Write(w)
+}
+
+// observeRequest records a baidu api request, status is the status of the
+// response or "error" when there was none.
+func observeRequest(api string, start time.Time, status string) {
+	metrics.requests.Add(1, api, status)
+	metrics.latency.Observe(time.Since(start).Seconds(), api)
+}
+
+// serveMetrics serves /metrics on addr until ctx is done.
+func (m *Map) serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	m.log.Infof("Serve metrics on %v/metrics", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		m.log.Errorf("Serving metrics fails, err: %v", err)
+	}
+}
+
+// pushMetrics replaces the metrics of this job and instance on a
+// pushgateway.
+func (m *Map) pushMetrics(gateway string) error {
+	buf := &bytes.Buffer{}
+	metrics.Write(buf)
+	target := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + pushgateway_job + "/instance/" + url.PathEscape(m.owner)
+	resp, err := m.restyClient.R().SetHeader("Content-Type", metrics_content).SetBody(buf.Bytes()).Put(target)
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf("Pushgateway answers %v", resp.Status())
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const (
+	objective_total      = "total"
+	objective_bottleneck = "bottleneck"
+	objective_minmax     = "minmax"
+	objective_capped     = "capped"
+	sheet_objectives     = "objectives"
+)
+
+var objectives = []string{objective_total, objective_bottleneck, objective_minmax, objective_capped, objective_stable}
+
+// ObjectiveStats describes the commutes of an assignment. It is saved on
+// the run document so that reorganisations can be compared.
+type ObjectiveStats struct {
+	Objective  string  `bson:"objective" json:"objective"`
+	Assigned   int     `bson:"assigned" json:"assigned"`
+	Unassigned int     `bson:"unassigned" json:"unassigned"`
+	Total      int     `bson:"total" json:"total"` // minutes
+	Mean       float64 `bson:"mean" json:"mean"`
+	P90        int     `bson:"p90" json:"p90"`
+	Max        int     `bson:"max" json:"max"`
+}
+
+func countAssigned(assigned []int) int {
+	n := 0
+	for _, j := range assigned {
+		if j != unassigned {
+			n++
+		}
+	}
+	return n
+}
+
+// distinctCosts returns the distinct routed costs, sorted.
+func distinctCosts(seconds [][]int) []int {
+	seen := map[int]bool{}
+	r := []int{}
+	for _, row := range seconds {
+		for _, s := range row {
+			if s != no_route && !seen[s] {
+				seen[s] = true
+				r = append(r, s)
+			}
+		}
+	}
+	sort.Ints(r)
+	return r
+}
+
+// solveBottleneck minimises the longest commute without leaving more
+// persons unassigned than solveMinCost does, then minimises the total. The
+// persons not allowed are not assigned.
+func solveBottleneck(seconds [][]int, capacity []int, allowed func(i, j int) bool) ([]int, int) {
+	best := countAssignable(seconds, capacity, allowed)
+	return bottleneck(seconds, capacity, allowed, distinctCosts(seconds), best)
+}
+
+// bottleneck returns the least total assignment within the limit of
+// bottleneckLimit.
+func bottleneck(seconds [][]int, capacity []int, allowed func(i, j int) bool, costs []int, best int) ([]int, int) {
+	if len(costs) == 0 || best == 0 {
+		return solveMinCost(seconds, capacity, allowed), no_route
+	}
+	limit := bottleneckLimit(seconds, capacity, allowed, costs, best)
+	return solveMinCost(seconds, capacity, func(i, j int) bool {
+		return seconds[i][j] <= limit && (allowed == nil || allowed(i, j))
+	}), limit
+}
+
+// bottleneckLimit searches the sorted costs for the least limit under which
+// best persons are still assigned, the last cost must allow it.
+func bottleneckLimit(seconds [][]int, capacity []int, allowed func(i, j int) bool, costs []int, best int) int {
+	lo, hi := 0, len(costs)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		limit := costs[mid]
+		n := countAssignable(seconds, capacity, func(i, j int) bool {
+			return seconds[i][j] <= limit && (allowed == nil || allowed(i, j))
+		})
+		if n >= best {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return costs[lo]
+}
+
+// toMinutes returns the commutes in whole minutes.
+func toMinutes(seconds [][]int) [][]int {
+	r := make([][]int, len(seconds))
+	for i, row := range seconds {
+		r[i] = make([]int, len(row))
+		for j, s := range row {
+			r[i][j] = no_route
+			if s != no_route {
+				r[i][j] = s / 60
+			}
+		}
+	}
+	return r
+}
+
+// solveMinMax minimises the longest commute, then the number of persons
+// with it, and goes on with the other persons in the same way. Commutes are
+// compared by the minute, as they are reported, which keeps the number of
+// rounds small. The persons with the longest commute are kept at the offices
+// of one optimal solution, so ties between them are broken by the solver
+// rather than searched. The limits only go down and the persons fixed at
+// one were part of a largest assignment, so every round searches the costs
+// below the last limit for as many persons as before but the fixed ones.
+func solveMinMax(seconds [][]int, capacity []int, allowed func(i, j int) bool) []int {
+	minutes := toMinutes(seconds)
+	r := make([]int, len(seconds))
+	free := make([]bool, len(seconds))
+	for i := range r {
+		r[i] = unassigned
+		free[i] = true
+	}
+	left := append([]int{}, capacity...)
+	costs := distinctCosts(minutes)
+	best := countAssignable(minutes, left, allowed)
+	for best > 0 {
+		isFree := func(i, j int) bool { return free[i] && (allowed == nil || allowed(i, j)) }
+		limit := bottleneckLimit(minutes, left, isFree, costs, best)
+		costs = costs[:sort.SearchInts(costs, limit)+1]
+		// fewest persons at the limit, every cheaper pair costs nothing
+		weights := make([][]int, len(minutes))
+		for i, row := range minutes {
+			weights[i] = make([]int, len(row))
+			for j, s := range row {
+				switch {
+				case s == no_route || s > limit:
+					weights[i][j] = no_route
+				case s == limit:
+					weights[i][j] = 1
+				}
+			}
+		}
+		assigned := solveMinCost(weights, left, isFree)
+		fixed := 0
+		for i, j := range assigned {
+			if j != unassigned && minutes[i][j] == limit {
+				r[i], free[i] = j, false
+				left[j]--
+				fixed++
+			}
+		}
+		if fixed == 0 {
+			// everybody left is below the limit, which can not happen
+			// for a minimal limit; keep the solution as it is
+			for i, j := range assigned {
+				if j != unassigned {
+					r[i] = j
+				}
+			}
+			return r
+		}
+		best -= fixed
+	}
+	return r
+}
+
+// solveObjective assigns persons under one of the objectives, within the
+// constraints of the workbook if it has any, and returns the constraints
+// it could not honour.
+func (m *Map) solveObjective(objective string, costs *Costs, capacity []int) ([]int, []string) {
+	solve := func(capacity []int, allowed func(i, j int) bool) []int {
+		return m.solveAllowed(objective, costs, capacity, allowed)
+	}
+	if m.constraints == nil {
+		return solve(capacity, nil), nil
+	}
+	return m.constraints.solve(costs, capacity, solve)
+}
+
+// solveAllowed assigns persons under one of the objectives, using only the
+// pairs allowed, nil allows every routed pair.
+func (m *Map) solveAllowed(objective string, costs *Costs, capacity []int, allowed func(i, j int) bool) []int {
+	switch objective {
+	case objective_bottleneck:
+		assigned, _ := solveBottleneck(costs.Seconds, capacity, allowed)
+		return assigned
+	case objective_minmax:
+		return solveMinMax(costs.Seconds, capacity, allowed)
+	case objective_stable:
+		return solveStable(m.preferences, capacity, allowed)
+	case objective_capped:
+		limit := m.cfg.CapMinutes * 60
+		return solveMinCost(costs.Seconds, capacity, func(i, j int) bool {
+			return costs.Seconds[i][j] <= limit && (allowed == nil || allowed(i, j))
+		})
+	default:
+		return solveMinCost(costs.Seconds, capacity, allowed)
+	}
+}
+
+func objectiveStats(objective string, costs *Costs, assigned []int) ObjectiveStats {
+	s := ObjectiveStats{Objective: objective}
+	minutes := []int{}
+	for i, j := range assigned {
+		if j == unassigned {
+			s.Unassigned++
+			continue
+		}
+		if costs.Seconds[i][j] == no_route {
+			continue // a stated preference without a route
+		}
+		minutes = append(minutes, costs.Seconds[i][j]/60)
+		s.Total += costs.Seconds[i][j] / 60
+	}
+	s.Assigned = len(assigned) - s.Unassigned
+	if len(minutes) == 0 {
+		return s
+	}
+	sort.Ints(minutes)
+	s.Mean = float64(s.Total) / float64(len(minutes))
+	s.P90 = minutes[(len(minutes)*9+9)/10-1]
+	s.Max = minutes[len(minutes)-1]
+	return s
+}
+
+func (m *Map) objectiveName(objective string) string {
+	if objective == objective_capped {
+		return fmt.Sprintf("%v %d", objective, m.cfg.CapMinutes)
+	}
+	return objective
+}
+
+// compareObjectives solves every other objective next to the assignment of
+// the configured one and returns their statistics.
+func (m *Map) compareObjectives(costs *Costs, capacity []int, assigned []int) []ObjectiveStats {
+	r := []ObjectiveStats{}
+	for _, objective := range objectives {
+		if objective == objective_capped && m.cfg.CapMinutes <= 0 {
+			continue
+		}
+		solved := assigned
+		if objective != m.cfg.Objective {
+			solved, _ = m.solveObjective(objective, costs, capacity)
+		}
+		r = append(r, objectiveStats(m.objectiveName(objective), costs, solved))
+	}
+	return r
+}
+
+func printObjectives(stats []ObjectiveStats) {
+	fmt.Fprintf(os.Stdout, "%-14v %8v %10v %8v %8v %8v %6v\n", "objective", "assigned", "unassigned", "total", "mean", "p90", "max")
+	for _, s := range stats {
+		fmt.Fprintf(os.Stdout, "%-14v %8d %10d %8d %8.1f %8d %6d\n", s.Objective, s.Assigned, s.Unassigned, s.Total, s.Mean, s.P90, s.Max)
+	}
+}
+
+// fillObjectives writes the comparison of the objectives to its own sheet.
+func (m *Map) fillObjectives(stats []ObjectiveStats) {
+	m.excelFile.DeleteSheet(sheet_objectives)
+	m.excelFile.NewSheet(sheet_objectives)
+	header := []interface{}{"objective", "assigned", "unassigned", "total", "mean", "p90", "max"}
+	m.excelFile.SetSheetRow(sheet_objectives, "A1", &header)
+	for i, s := range stats {
+		row := []interface{}{s.Objective, s.Assigned, s.Unassigned, s.Total, s.Mean, s.P90, s.Max}
+		m.excelFile.SetSheetRow(sheet_objectives, "A"+strconv.Itoa(i+2), &row)
+	}
+}
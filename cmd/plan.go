@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const earth_radius_km = 6371.0
+
+// matrixModes are the modes the route matrix api supports, transit is only
+// routed pair by pair.
+var matrixModes = []string{"walk", "ride", "drive"}
+
+// modePlan is the routing estimate of one mode.
+type modePlan struct {
+	pairs    int
+	cached   int
+	filtered int
+	calls    int
+	batches  int
+}
+
+// distanceKm returns the great-circle distance between two POIs.
+func distanceKm(a, b Poi) float64 {
+	lat1, lat2 := a.Lat*math.Pi/180, b.Lat*math.Pi/180
+	dLat := lat2 - lat1
+	dLng := (b.Lng - a.Lng) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earth_radius_km * math.Asin(math.Sqrt(h))
+}
+
+// withinReach tells whether a pair has to be routed. Pairs are only
+// prefiltered when both POIs are known.
+func (m *Map) withinReach(a, b Poi) bool {
+	if m.cfg.MaxDistanceKm <= 0 || isZeroPoi(a) || isZeroPoi(b) {
+		return true
+	}
+	return distanceKm(a, b) <= m.cfg.MaxDistanceKm
+}
+
+// callTime estimates how long n api calls take, bound by the qps limit or
+// by the workers waiting on responses, whichever is slower.
+func (m *Map) callTime(n int) time.Duration {
+	workers := m.cfg.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	d := time.Duration(n) * call_latency / time.Duration(workers)
+	if m.cfg.QPS > 0 {
+		if byQPS := time.Duration(n) * time.Second / time.Duration(m.cfg.QPS); byQPS > d {
+			d = byQPS
+		}
+	}
+	return d.Round(time.Second)
+}
+
+// plannedPois returns the POI every person and office will have after
+// geocoding, as far as it is known without calling the server, and the
+// addresses that have to be geocoded.
+func (m *Map) plannedPois() (map[primitive.ObjectID]Poi, map[string]string, error) {
+	pois := map[primitive.ObjectID]Poi{}
+	raw := map[string]string{}
+	for _, p := range m.personSlice {
+		pois[p.Id] = p.Poi
+		if isZeroPoi(p.Poi) {
+			raw[normalizeAddress(p.Address)] = p.Address
+		}
+	}
+	for _, o := range m.officeSlice {
+		pois[o.Id] = o.Poi
+		if isZeroPoi(o.Poi) {
+			raw[normalizeAddress(o.Address)] = o.Address
+		}
+	}
+	addresses := make([]string, 0, len(raw))
+	for addr := range raw {
+		addresses = append(addresses, addr)
+	}
+	cached, err := m.cachedPois(addresses)
+	if err != nil {
+		return nil, nil, err
+	}
+	for addr := range cached {
+		delete(raw, addr)
+	}
+	for _, p := range m.personSlice {
+		if poi, ok := cached[normalizeAddress(p.Address)]; ok && isZeroPoi(p.Poi) {
+			pois[p.Id] = poi
+		}
+	}
+	for _, o := range m.officeSlice {
+		if poi, ok := cached[normalizeAddress(o.Address)]; ok && isZeroPoi(o.Poi) {
+			pois[o.Id] = poi
+		}
+	}
+	return pois, raw, nil
+}
+
+// cachedRoutes returns the stored durations of the workbook, keyed by
+// person, office and mode.
+func (m *Map) cachedRoutes() (map[string]bool, error) {
+	stored := []PairDuration{}
+	err := m.durations().Find(m.ctx, m.workbookFilter()).Select(bson.M{"person_id": 1, "office_id": 1, "mode": 1}).All(&stored)
+	if err != nil {
+		return nil, err
+	}
+	r := make(map[string]bool, len(stored))
+	for _, d := range stored {
+		r[d.PersonId.Hex()+d.OfficeId.Hex()+d.Mode] = true
+	}
+	return r, nil
+}
+
+// showPlan prints what a run of the workbook would cost: the geocoding and
+// routing calls left after the caches and the distance prefilter, the matrix
+// batches they fit in, the time they take and the share of the daily quota
+// they use. It only reads the workbook and the store.
+func (m *Map) showPlan() error {
+	if err := m.loadExecelData(m.cfg.ExcelFile); err != nil {
+		return err
+	}
+	pois, raw, err := m.plannedPois()
+	if err != nil {
+		return err
+	}
+	cached, err := m.cachedRoutes()
+	if err != nil {
+		return err
+	}
+
+	plans := map[string]*modePlan{}
+	for _, mode := range m.cfg.Modes {
+		plans[mode] = &modePlan{}
+	}
+	for _, p := range m.personSlice {
+		uncached := map[string]int{}
+		for _, o := range m.officeSlice {
+			for _, mode := range m.cfg.Modes {
+				plan := plans[mode]
+				plan.pairs++
+				// a zero POI means the address is new or changed, its
+				// durations are dropped when the run loads the workbook
+				if !isZeroPoi(p.Poi) && !isZeroPoi(o.Poi) && cached[p.Id.Hex()+o.Id.Hex()+mode] {
+					plan.cached++
+					continue
+				}
+				if !m.withinReach(pois[p.Id], pois[o.Id]) {
+					plan.filtered++
+					continue
+				}
+				plan.calls++
+				uncached[mode]++
+			}
+		}
+		for mode, n := range uncached {
+			plans[mode].batches += (n + matrix_elements - 1) / matrix_elements
+		}
+	}
+
+	fmt.Printf("Workbook %v: %d persons, %d offices\n", m.cfg.ExcelFile, len(m.personSlice), len(m.officeSlice))
+	fmt.Printf("Geocoding: %d distinct addresses to geocode\n", len(raw))
+	fmt.Printf("%-10v %8v %8v %8v %8v %8v\n", "mode", "pairs", "cached", "filtered", "calls", "batches")
+	routeCalls, matrixCalls := 0, 0
+	for _, mode := range m.cfg.Modes {
+		plan := plans[mode]
+		batches := "-"
+		if containsString(matrixModes, mode) {
+			batches = fmt.Sprint(plan.batches)
+			matrixCalls += plan.batches
+		} else {
+			matrixCalls += plan.calls
+		}
+		routeCalls += plan.calls
+		fmt.Printf("%-10v %8d %8d %8d %8d %8v\n", mode, plan.pairs, plan.cached, plan.filtered, plan.calls, batches)
+	}
+	if m.cfg.MaxDistanceKm <= 0 {
+		fmt.Printf("No distance prefilter, set -max-distance to skip far pairs\n")
+	}
+
+	calls := len(raw) + routeCalls
+	fmt.Printf("Api calls: %d pair by pair, %d with the route matrix\n", calls, len(raw)+matrixCalls)
+	fmt.Printf("Estimated time: %v at %d qps with %d workers\n", m.callTime(calls), m.cfg.QPS, m.cfg.Workers)
+	if m.cfg.Quota > 0 {
+		fmt.Printf("Daily quota: %d of %d calls (%.1f%%), %d day(s)\n", calls, m.cfg.Quota, 100*float64(calls)/float64(m.cfg.Quota), (calls+m.cfg.Quota-1)/m.cfg.Quota)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Task is one unit of work run by a Pool.
+type Task func(ctx context.Context)
+
+// Limiter spaces out calls so that at most qps of them start per second.
+// It is shared by every pool that talks to the same API key.
+type Limiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newLimiter returns a limiter for qps calls per second, or nil when qps is
+// not positive. A nil limiter does not limit.
+func newLimiter(qps int) *Limiter {
+	if qps <= 0 {
+		return nil
+	}
+	return &Limiter{interval: time.Second / time.Duration(qps)}
+}
+
+// Wait blocks until the next call may start or ctx is cancelled.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return ctx.Err()
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	l.next = l.next.Add(l.interval)
+	l.lock.Unlock()
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Pool runs tasks on a bounded number of goroutines, starting them no faster
+// than its limiter allows.
+type Pool struct {
+	workers int
+	limiter *Limiter
+}
+
+func newPool(workers int, limiter *Limiter) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Pool{workers: workers, limiter: limiter}
+}
+
+// Run executes the tasks received from tasks, passing them calls as the
+// context of their api calls. It returns once tasks is closed and every
+// worker is idle, or once ctx is cancelled and the running tasks have
+// returned. Cancelling ctx only stops new tasks from starting.
+func (p *Pool) Run(ctx, calls context.Context, tasks <-chan Task) {
+	metrics.poolWorkers.Set(float64(p.workers))
+	defer metrics.poolWorkers.Set(0)
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case task, ok := <-tasks:
+					if !ok {
+						return
+					}
+					if p.limiter.Wait(ctx) != nil {
+						// let the task report that it was not run
+						task(ctx)
+						return
+					}
+					metrics.poolBusy.Add(1)
+					task(calls)
+					metrics.poolBusy.Add(-1)
+					metrics.poolTasks.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
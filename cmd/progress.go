@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stage_geocode = "geocode"
+	stage_route   = "route"
+	stage_load    = "load"
+	stage_rank    = "rank"
+	stage_excel   = "excel"
+
+	bar_width      = 30
+	bar_interval   = 200 * time.Millisecond
+	log_interval   = 10 * time.Second
+	rate_window    = 30 * time.Second
+	no_mode        = "-"
+	progress_clear = "\r\033[K"
+)
+
+// StageSummary is the outcome of one stage and mode of a run. It is saved
+// on the run document.
+type StageSummary struct {
+	Stage   string        `bson:"stage" json:"stage"`
+	Mode    string        `bson:"mode" json:"mode"`
+	Total   int           `bson:"total" json:"total"`
+	Done    int           `bson:"done" json:"done"`
+	Failed  int           `bson:"failed" json:"failed"`
+	Calls   int           `bson:"calls" json:"calls"`
+	Elapsed time.Duration `bson:"elapsed" json:"elapsed"`
+}
+
+type modeCount struct {
+	total  int
+	done   int
+	failed int
+	calls  int
+}
+
+// Progress follows the stage being run. It draws a bar when the output is a
+// terminal and logs a line now and then otherwise.
+type Progress struct {
+	lock    sync.Mutex
+	out     io.Writer
+	tty     bool
+	log     *logrus.Logger
+	quota   int
+	stage   string
+	total   int
+	start   time.Time
+	modes   map[string]*modeCount
+	calls   int       // api calls of the whole run
+	samples []callAt  // recent calls, for the call rate
+	stop    chan bool // stops the reporter of the stage
+	stopped chan bool
+	summary []StageSummary
+}
+
+type callAt struct {
+	at    time.Time
+	calls int
+}
+
+func newProgress(log *logrus.Logger, quota int) *Progress {
+	tty := false
+	if fi, err := os.Stderr.Stat(); err == nil {
+		tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	return &Progress{out: os.Stderr, tty: tty, log: log, quota: quota}
+}
+
+// Start begins a stage and its reporter, totals are the items to do per
+// mode.
+func (p *Progress) Start(stage string, totals map[string]int) {
+	p.End()
+	p.lock.Lock()
+	p.stage = stage
+	p.total = 0
+	p.start = time.Now()
+	p.modes = map[string]*modeCount{}
+	for mode, n := range totals {
+		p.count(mode).total = n
+		p.total += n
+	}
+	p.samples = []callAt{{at: p.start, calls: p.calls}}
+	p.stop = make(chan bool)
+	p.stopped = make(chan bool)
+	p.lock.Unlock()
+	go p.report(p.stop, p.stopped)
+}
+
+// Call counts one api call.
+func (p *Progress) Call(mode string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.calls++
+	if p.modes != nil {
+		p.count(mode).calls++
+	}
+}
+
+// Add counts one finished item of the stage.
+func (p *Progress) Add(mode string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.modes == nil {
+		return
+	}
+	if err != nil {
+		p.count(mode).failed++
+	} else {
+		p.count(mode).done++
+	}
+}
+
+func (p *Progress) count(mode string) *modeCount {
+	if mode == "" {
+		mode = no_mode
+	}
+	c := p.modes[mode]
+	if c == nil {
+		c = &modeCount{}
+		p.modes[mode] = c
+	}
+	return c
+}
+
+// End stops the reporter of the stage and keeps its summary.
+func (p *Progress) End() {
+	p.lock.Lock()
+	if p.modes == nil {
+		p.lock.Unlock()
+		return
+	}
+	close(p.stop)
+	stopped := p.stopped
+	p.lock.Unlock()
+	<-stopped
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	elapsed := time.Since(p.start).Round(time.Second)
+	modes := make([]string, 0, len(p.modes))
+	for mode := range p.modes {
+		modes = append(modes, mode)
+	}
+	sort.Strings(modes)
+	for _, mode := range modes {
+		c := p.modes[mode]
+		p.summary = append(p.summary, StageSummary{
+			Stage:   p.stage,
+			Mode:    mode,
+			Total:   c.total,
+			Done:    c.done,
+			Failed:  c.failed,
+			Calls:   c.calls,
+			Elapsed: elapsed,
+		})
+	}
+	p.line(true)
+	p.modes = nil
+}
+
+// ProgressState is the state of the running stage.
+type ProgressState struct {
+	Stage  string `json:"stage"`
+	Total  int    `json:"total"`
+	Done   int    `json:"done"`
+	Failed int    `json:"failed"`
+	Calls  int    `json:"calls"`
+}
+
+// State returns the state of the running stage.
+func (p *Progress) State() ProgressState {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := ProgressState{Stage: p.stage, Total: p.total, Calls: p.calls}
+	for _, c := range p.modes {
+		s.Done += c.done
+		s.Failed += c.failed
+	}
+	return s
+}
+
+// Summary returns the summaries of the stages that ended.
+func (p *Progress) Summary() []StageSummary {
+	p.End()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return append([]StageSummary{}, p.summary...)
+}
+
+func (p *Progress) report(stop, stopped chan bool) {
+	defer close(stopped)
+	interval := log_interval
+	if p.tty {
+		interval = bar_interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			p.lock.Lock()
+			p.line(false)
+			p.lock.Unlock()
+		}
+	}
+}
+
+// line draws the bar or logs the state of the stage, final is the last
+// line of the stage. It is called with the lock held.
+func (p *Progress) line(final bool) {
+	done, failed := 0, 0
+	for _, c := range p.modes {
+		done += c.done
+		failed += c.failed
+	}
+
+	now := time.Now()
+	p.samples = append(p.samples, callAt{at: now, calls: p.calls})
+	for len(p.samples) > 2 && now.Sub(p.samples[0].at) > rate_window {
+		p.samples = p.samples[1:]
+	}
+	rate := 0.0
+	if first := p.samples[0]; now.Sub(first.at) > 0 {
+		rate = float64(p.calls-first.calls) / now.Sub(first.at).Seconds()
+	}
+	eta := "-"
+	if finished := done + failed; finished > 0 && p.total > finished {
+		perItem := time.Since(p.start) / time.Duration(finished)
+		eta = (perItem * time.Duration(p.total-finished)).Round(time.Second).String()
+	}
+	quota := ""
+	if p.quota > 0 {
+		quota = fmt.Sprintf(", quota %d/%d (%.1f%%)", p.calls, p.quota, 100*float64(p.calls)/float64(p.quota))
+	}
+	label := "routed"
+	if p.stage == stage_geocode {
+		label = "geocoded"
+	}
+	state := fmt.Sprintf("%v %d/%d, failed %d, %.1f calls/s, eta %v%v", label, done, p.total, failed, rate, eta, quota)
+
+	if !p.tty {
+		if final {
+			p.log.Infof("%v finished: %v", strings.Title(p.stage), state)
+		} else {
+			p.log.Infof("%v: %v", strings.Title(p.stage), state)
+		}
+		return
+	}
+	filled := bar_width
+	if p.total > 0 {
+		filled = bar_width * (done + failed) / p.total
+		if filled > bar_width {
+			filled = bar_width
+		}
+	}
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", bar_width-filled)
+	fmt.Fprintf(p.out, "%v%-8v [%v] %v", progress_clear, p.stage, bar, state)
+	if final {
+		fmt.Fprintln(p.out)
+	}
+}
+
+// printSummary prints the summary table of the run.
+func printSummary(w io.Writer, summary []StageSummary) {
+	if len(summary) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%-8v %-10v %8v %8v %8v %8v %10v\n", "stage", "mode", "total", "done", "failed", "calls", "elapsed")
+	for _, s := range summary {
+		fmt.Fprintf(w, "%-8v %-10v %8d %8d %8d %8d %10v\n", s.Stage, s.Mode, s.Total, s.Done, s.Failed, s.Calls, s.Elapsed)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// QueryOffice is an office reachable from the queried address.
+type QueryOffice struct {
+	Name       string         `json:"name"`
+	Address    string         `json:"address"`
+	DistanceKm float64        `json:"distance_km"`
+	Mode       string         `json:"mode"`    // fastest mode
+	Minutes    int            `json:"minutes"` // by the fastest mode
+	Modes      map[string]int `json:"modes"`   // minutes per mode
+	Cached     bool           `json:"cached"`
+}
+
+// QueryResult ranks the offices for an address that is not in the workbook.
+type QueryResult struct {
+	Address     string        `json:"address,omitempty"`
+	Poi         Poi           `json:"poi"`
+	Offices     []QueryOffice `json:"offices"`
+	Prefiltered int           `json:"prefiltered"` // offices beyond the max distance
+	Calls       int           `json:"calls"`
+}
+
+// parseCoordinate parses "lat,lng".
+func parseCoordinate(s string) (Poi, bool) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return Poi{}, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return Poi{}, false
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return Poi{}, false
+	}
+	return Poi{Lat: lat, Lng: lng}, true
+}
+
+// queryPoi returns the poi of the address, from the geocode cache when it
+// is there. The geocoded poi is only cached when save is set.
+func (m *Map) queryPoi(ctx context.Context, address string, save bool) (Poi, bool, error) {
+	normalized := normalizeAddress(address)
+	cached, err := m.cachedPois([]string{normalized})
+	if err != nil {
+		m.log.Errorf("Reading geocode cache fails, err: %v", err)
+	}
+	if poi, ok := cached[normalized]; ok {
+		metrics.cache.Add(1, "geocode", "hit")
+		return poi, false, nil
+	}
+	metrics.cache.Add(1, "geocode", "miss")
+	if err := m.limiter.Wait(ctx); err != nil {
+		return Poi{}, false, err
+	}
+	poi, err := m.getPoi(ctx, address)
+	if err != nil {
+		return Poi{}, true, err
+	}
+	if save {
+		g := Geocode{Region: m.cfg.Region, Address: normalized, Raw: address, Poi: poi, ComputedAt: time.Now()}
+		if err := m.geocodeWriter.Upsert(m.ctx, bson.M{"region": g.Region, "address": g.Address}, g); err != nil {
+			return poi, true, err
+		}
+		if err := m.geocodeWriter.Flush(m.ctx); err != nil {
+			return poi, true, err
+		}
+	}
+	return poi, true, nil
+}
+
+// cachedQueryRoutes returns the stored minutes per office and mode of a
+// person of the store living at poi, if there is one.
+func (m *Map) cachedQueryRoutes(poi Poi) (map[string]map[string]int, error) {
+	r := map[string]map[string]int{}
+	persons := []Person{}
+	if err := m.mongoCli.Find(m.ctx, bson.M{"poi.lat": poi.Lat, "poi.lng": poi.Lng}).All(&persons); err != nil {
+		return r, err
+	}
+	if len(persons) == 0 {
+		return r, nil
+	}
+	durations := []PairDuration{}
+	err := m.durations().Find(m.ctx, bson.M{"person_id": persons[0].Id, "mode": bson.M{"$in": m.cfg.Modes}}).All(&durations)
+	if err != nil {
+		return r, err
+	}
+	for _, d := range durations {
+		id := d.OfficeId.Hex()
+		if r[id] == nil {
+			r[id] = map[string]int{}
+		}
+		r[id][d.Mode] = d.Seconds / 60
+	}
+	return r, nil
+}
+
+// query ranks offices for an address or a coordinate. Routes come from the
+// durations of a person at the same poi when there is one, offices beyond
+// the max distance are skipped, and nothing is stored unless save is set.
+// within drops the offices further than that many minutes, 0 keeps all.
+func (m *Map) query(ctx context.Context, address string, offices []Office, within int, save bool) (*QueryResult, error) {
+	r := &QueryResult{Offices: []QueryOffice{}}
+	if poi, ok := parseCoordinate(address); ok {
+		r.Poi = poi
+	} else {
+		r.Address = address
+		poi, called, err := m.queryPoi(ctx, address, save)
+		if called {
+			r.Calls++
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Can not geocode %v, err: %v", address, err)
+		}
+		r.Poi = poi
+	}
+	cached, err := m.cachedQueryRoutes(r.Poi)
+	if err != nil {
+		m.log.Errorf("Reading cached routes fails, err: %v", err)
+	}
+
+	var lock sync.Mutex
+	results := map[int]*QueryOffice{}
+	tasks := make(chan Task)
+	go func() {
+		defer close(tasks)
+		for i, o := range offices {
+			if isZeroPoi(o.Poi) {
+				continue
+			}
+			if !m.withinReach(r.Poi, o.Poi) {
+				r.Prefiltered++
+				continue
+			}
+			qo := &QueryOffice{Name: o.Name, Address: o.Address, DistanceKm: distanceKm(r.Poi, o.Poi), Modes: map[string]int{}}
+			results[i] = qo
+			if modes, ok := cached[o.Id.Hex()]; ok && len(modes) == len(m.cfg.Modes) {
+				qo.Modes, qo.Cached = modes, true
+				continue
+			}
+			for _, mode := range m.cfg.Modes {
+				mode, dest := mode, o.Poi
+				task := func(ctx context.Context) {
+					route, err := m.calRoute(ctx, r.Poi, dest, mode)
+					lock.Lock()
+					defer lock.Unlock()
+					r.Calls++
+					if err != nil {
+						m.log.Errorf("Routing %v to %v fails, err: %v", mode, qo.Name, err)
+						return
+					}
+					qo.Modes[mode] = route.Duration / 60
+				}
+				select {
+				case tasks <- task:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	newPool(m.cfg.Workers, m.limiter).Run(ctx, ctx, tasks)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, qo := range results {
+		if len(qo.Modes) == 0 {
+			continue
+		}
+		qo.Minutes = -1
+		for mode, minutes := range qo.Modes {
+			if qo.Minutes < 0 || minutes < qo.Minutes || (minutes == qo.Minutes && mode < qo.Mode) {
+				qo.Mode, qo.Minutes = mode, minutes
+			}
+		}
+		if within > 0 && qo.Minutes > within {
+			continue
+		}
+		r.Offices = append(r.Offices, *qo)
+	}
+	sort.Slice(r.Offices, func(i, j int) bool {
+		if r.Offices[i].Minutes != r.Offices[j].Minutes {
+			return r.Offices[i].Minutes < r.Offices[j].Minutes
+		}
+		return r.Offices[i].Name < r.Offices[j].Name
+	})
+	return r, nil
+}
+
+// showQuery prints the offices for the address given on the command line,
+// using the offices of the workbook.
+func (m *Map) showQuery(address string) error {
+	m.dryRun = true
+	if err := m.loadExecelData(m.cfg.ExcelFile); err != nil {
+		return err
+	}
+	pois, _, err := m.plannedPois()
+	if err != nil {
+		return err
+	}
+	offices := append([]Office{}, m.officeSlice...)
+	for i := range offices {
+		offices[i].Poi = pois[offices[i].Id]
+	}
+	r, err := m.query(m.interrupted, address, offices, m.cfg.Within, m.cfg.Save)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v (%f,%f), %d api calls, %d offices beyond %v km\n", address, r.Poi.Lat, r.Poi.Lng, r.Calls, r.Prefiltered, m.cfg.MaxDistanceKm)
+	fmt.Printf("%-4v %-20v %6v %8v %-10v %v\n", "#", "office", "min", "km", "mode", "per mode")
+	for i, o := range r.Offices {
+		modes := []string{}
+		for _, mode := range m.cfg.Modes {
+			if minutes, ok := o.Modes[mode]; ok {
+				modes = append(modes, fmt.Sprintf("%v %d", mode, minutes))
+			}
+		}
+		fmt.Printf("%-4d %-20v %6d %8.1f %-10v %v\n", i+1, o.Name, o.Minutes, o.DistanceKm, o.Mode, strings.Join(modes, ", "))
+	}
+	return nil
+}
+
+// handleQuery serves /api/query?address=... or ?lat=...&lng=..., with the
+// offices of a run (run=, the latest finished run by default). within and
+// save work like the flags of the query command.
+func (s *service) handleQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	address := q.Get("address")
+	if q.Get("lat") != "" || q.Get("lng") != "" {
+		address = q.Get("lat") + "," + q.Get("lng")
+		if _, ok := parseCoordinate(address); !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid coordinate"))
+			return
+		}
+	}
+	if address == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("address or lat and lng are required"))
+		return
+	}
+	within, _ := strconv.Atoi(q.Get("within"))
+	_, snapshots, err := s.dashboardSnapshot(r)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	offices := make([]Office, 0, len(snapshots))
+	entities := []Office{}
+	names := make([]string, 0, len(snapshots))
+	for _, o := range snapshots {
+		names = append(names, o.Name)
+	}
+	if err := s.m.mongoCli.Find(r.Context(), bson.M{"name": bson.M{"$in": names}}).All(&entities); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ids := map[string]Office{}
+	for _, e := range entities {
+		ids[e.Name] = e
+	}
+	for _, o := range snapshots {
+		offices = append(offices, Office{Id: ids[o.Name].Id, Name: o.Name, Address: o.Address, Poi: o.Poi})
+	}
+	result, err := s.m.query(r.Context(), address, offices, within, q.Get("save") == "true")
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
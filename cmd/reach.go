@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	stage_reach    = "reach"
+	sheet_reach    = "reachability"
+	sheet_coverage = "coverage"
+	mode_any       = "any" // the fastest mode allowed for the person
+)
+
+// reach_thresholds are the commutes in minutes the report counts persons
+// within, the last one decides the coverage.
+var reach_thresholds = []int{15, 30, 45, 60}
+
+// Reach lists the persons who can reach an office within some minutes by
+// one mode.
+type Reach struct {
+	Office  string   `bson:"office" json:"office"`
+	Mode    string   `bson:"mode" json:"mode"`
+	Minutes int      `bson:"minutes" json:"minutes"`
+	Persons []string `bson:"persons" json:"persons"`
+}
+
+// Uncovered is a person without any office within the last threshold, with
+// the fastest commute there is, if any.
+type Uncovered struct {
+	Person  string `bson:"person" json:"person"`
+	Office  string `bson:"office" json:"office"`
+	Mode    string `bson:"mode" json:"mode"`
+	Minutes int    `bson:"minutes" json:"minutes"`
+}
+
+// reachability counts, from every stored duration of the workbook, the
+// persons reaching each office within each threshold by each mode and by
+// any of them.
+func (m *Map) reachability() error {
+	m.log.Infof("Count persons reaching every office")
+	durations := []PairDuration{}
+	err := m.durations().Find(m.ctx, m.workbookFilter()).Select(bson.M{"person_id": 1, "office_id": 1, "mode": 1, "seconds": 1}).All(&durations)
+	if err != nil {
+		return err
+	}
+	m.reach, m.uncovered = countReach(m.personSlice, m.officeSlice, m.cfg.Modes, durations)
+	limit := reach_thresholds[len(reach_thresholds)-1]
+	fmt.Fprintf(os.Stdout, "%d of %d persons have an office within %d minutes\n", len(m.personSlice)-len(m.uncovered), len(m.personSlice), limit)
+	for _, u := range m.uncovered {
+		if u.Minutes == no_route {
+			fmt.Fprintf(os.Stdout, "  %v: no route\n", u.Person)
+			continue
+		}
+		fmt.Fprintf(os.Stdout, "  %v: %v by %v in %d min\n", u.Person, u.Office, u.Mode, u.Minutes)
+	}
+	if m.run != nil {
+		m.run.Uncovered = m.uncovered
+	}
+	return nil
+}
+
+// countReach lists the persons reaching each office within each threshold
+// by each mode and by any of them, and the persons without any office
+// within the last threshold. Driving only counts for persons who can drive.
+func countReach(persons []Person, offices []Office, modes []string, durations []PairDuration) ([]Reach, []Uncovered) {
+	personIndex := make(map[string]int, len(persons))
+	for i, p := range persons {
+		personIndex[p.Id.Hex()] = i
+	}
+	officeIndex := make(map[string]int, len(offices))
+	for j, o := range offices {
+		officeIndex[o.Id.Hex()] = j
+	}
+	all := append(append([]string{}, modes...), mode_any)
+	// minutes[j][mode][i] is the commute of person i to office j
+	minutes := make([]map[string][]int, len(offices))
+	for j := range minutes {
+		minutes[j] = map[string][]int{}
+		for _, mode := range all {
+			minutes[j][mode] = make([]int, len(persons))
+			for i := range persons {
+				minutes[j][mode][i] = no_route
+			}
+		}
+	}
+	for _, d := range durations {
+		i, ok := personIndex[d.PersonId.Hex()]
+		if !ok {
+			continue
+		}
+		j, ok := officeIndex[d.OfficeId.Hex()]
+		if !ok || minutes[j][d.Mode] == nil || (d.Mode == "drive" && !persons[i].CanDrive) {
+			continue
+		}
+		minutes[j][d.Mode][i] = d.Seconds / 60
+		if fastest := minutes[j][mode_any][i]; fastest == no_route || d.Seconds/60 < fastest {
+			minutes[j][mode_any][i] = d.Seconds / 60
+		}
+	}
+
+	reach := []Reach{}
+	for j, o := range offices {
+		for _, mode := range all {
+			for _, t := range reach_thresholds {
+				r := Reach{Office: o.Name, Mode: mode, Minutes: t, Persons: []string{}}
+				for i, v := range minutes[j][mode] {
+					if v != no_route && v <= t {
+						r.Persons = append(r.Persons, persons[i].Name)
+					}
+				}
+				reach = append(reach, r)
+			}
+		}
+	}
+
+	limit := reach_thresholds[len(reach_thresholds)-1]
+	uncovered := []Uncovered{}
+	for i, p := range persons {
+		best := Uncovered{Person: p.Name, Minutes: no_route}
+		for j, o := range offices {
+			for _, mode := range modes {
+				if v := minutes[j][mode][i]; v != no_route && (best.Minutes == no_route || v < best.Minutes) {
+					best.Office, best.Mode, best.Minutes = o.Name, mode, v
+				}
+			}
+		}
+		if best.Minutes == no_route || best.Minutes > limit {
+			uncovered = append(uncovered, best)
+		}
+	}
+	return reach, uncovered
+}
+
+// covered counts the persons reaching some office within t minutes by any
+// mode.
+func (m *Map) covered(t int) int {
+	persons := map[string]bool{}
+	for _, r := range m.reach {
+		if r.Mode == mode_any && r.Minutes == t {
+			for _, p := range r.Persons {
+				persons[p] = true
+			}
+		}
+	}
+	return len(persons)
+}
+
+// fillReach writes the reachability of every office and the coverage to
+// their own sheets.
+func (m *Map) fillReach() {
+	m.excelFile.DeleteSheet(sheet_reach)
+	m.excelFile.NewSheet(sheet_reach)
+	header := []interface{}{"office", "mode", "minutes", "persons", "names"}
+	m.excelFile.SetSheetRow(sheet_reach, "A1", &header)
+	for k, r := range m.reach {
+		row := []interface{}{r.Office, r.Mode, r.Minutes, len(r.Persons), strings.Join(r.Persons, ", ")}
+		m.excelFile.SetSheetRow(sheet_reach, "A"+strconv.Itoa(k+2), &row)
+	}
+
+	m.excelFile.DeleteSheet(sheet_coverage)
+	m.excelFile.NewSheet(sheet_coverage)
+	header = []interface{}{"minutes", "persons covered", "persons"}
+	m.excelFile.SetSheetRow(sheet_coverage, "A1", &header)
+	line := 2
+	for _, t := range reach_thresholds {
+		row := []interface{}{t, m.covered(t), len(m.personSlice)}
+		m.excelFile.SetSheetRow(sheet_coverage, "A"+strconv.Itoa(line), &row)
+		line++
+	}
+	line++
+	header = []interface{}{"uncovered person", "fastest office", "mode", "minutes"}
+	m.excelFile.SetSheetRow(sheet_coverage, "A"+strconv.Itoa(line), &header)
+	for _, u := range m.uncovered {
+		line++
+		row := []interface{}{u.Person, u.Office, u.Mode, u.Minutes}
+		if u.Minutes == no_route {
+			row = []interface{}{u.Person, "", "", ""}
+		}
+		m.excelFile.SetSheetRow(sheet_coverage, "A"+strconv.Itoa(line), &row)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCountReach(t *testing.T) {
+	persons := []Person{
+		{Id: primitive.NewObjectID(), Name: "driver", CanDrive: true},
+		{Id: primitive.NewObjectID(), Name: "walker"},
+		{Id: primitive.NewObjectID(), Name: "nowhere"},
+	}
+	offices := []Office{{Id: primitive.NewObjectID(), Name: "east"}, {Id: primitive.NewObjectID(), Name: "west"}}
+	duration := func(i, j int, mode string, minutes int) PairDuration {
+		return PairDuration{PersonId: persons[i].Id, OfficeId: offices[j].Id, Mode: mode, Seconds: minutes*60 + 30}
+	}
+	durations := []PairDuration{
+		duration(0, 0, "walk", 40),
+		duration(0, 0, "drive", 10),
+		duration(0, 1, "walk", 14),
+		duration(1, 0, "walk", 70),
+		duration(1, 0, "drive", 5), // can not drive
+		duration(1, 1, "walk", 61),
+		duration(1, 1, "ride", 20), // not a mode of the run
+	}
+	reach, uncovered := countReach(persons, offices, []string{"walk", "drive"}, durations)
+
+	tests := []struct {
+		office string
+		mode   string
+		want   []string // persons within 15, 30, 45 and 60 minutes
+	}{
+		{"east", "walk", []string{"", "", "driver", "driver"}},
+		{"east", "drive", []string{"driver", "driver", "driver", "driver"}},
+		{"east", mode_any, []string{"driver", "driver", "driver", "driver"}},
+		{"west", "walk", []string{"driver", "driver", "driver", "driver"}},
+		{"west", "drive", []string{"", "", "", ""}},
+		{"west", mode_any, []string{"driver", "driver", "driver", "driver"}},
+	}
+	got := map[string][]string{}
+	for _, r := range reach {
+		got[fmt.Sprintf("%v %v %d", r.Office, r.Mode, r.Minutes)] = r.Persons
+	}
+	if len(reach) != len(tests)*len(reach_thresholds) {
+		t.Errorf("countReach() gives %d counts, want %d", len(reach), len(tests)*len(reach_thresholds))
+	}
+	for _, tt := range tests {
+		for k, minutes := range reach_thresholds {
+			want := []string{}
+			if tt.want[k] != "" {
+				want = append(want, tt.want[k])
+			}
+			if p := got[fmt.Sprintf("%v %v %d", tt.office, tt.mode, minutes)]; !reflect.DeepEqual(p, want) {
+				t.Errorf("%v by %v within %d minutes = %v, want %v", tt.office, tt.mode, minutes, p, want)
+			}
+		}
+	}
+
+	wantUncovered := []Uncovered{
+		{Person: "walker", Office: "west", Mode: "walk", Minutes: 61},
+		{Person: "nowhere", Minutes: no_route},
+	}
+	if !reflect.DeepEqual(uncovered, wantUncovered) {
+		t.Errorf("countReach() uncovered = %+v, want %+v", uncovered, wantUncovered)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	stage_rebalance   = "rebalance"
+	sheet_rebalance   = "rebalance"
+	default_max_moves = 10
+	default_saving    = 5 // minutes
+)
+
+// Move is one step of a rebalancing plan: a person moved to an office with
+// room, or two persons swapping offices. A swap counts as two moves.
+type Move struct {
+	Step       int    `bson:"step" json:"step"`
+	Kind       string `bson:"kind" json:"kind"` // move or swap
+	Person     string `bson:"person" json:"person"`
+	From       string `bson:"from" json:"from"`
+	To         string `bson:"to" json:"to"`
+	OldMinutes int    `bson:"old_minutes" json:"old_minutes"`
+	NewMinutes int    `bson:"new_minutes" json:"new_minutes"`
+	Saved      int    `bson:"saved" json:"saved"` // minutes
+}
+
+// readCurrentOffice reads the current office column of a person row.
+func readCurrentOffice(row []string) string {
+	if len(row) <= sheet_person_current_index {
+		return ""
+	}
+	return strings.TrimSpace(row[sheet_person_current_index])
+}
+
+// rebalancer searches moves and swaps from the current offices.
+type rebalancer struct {
+	seconds [][]int
+	current []int
+	left    []int // room left in every office
+	movable []bool
+	apart   [][]int
+	worst   bool // reduce the longest commute instead of the total
+	saving  int  // seconds a moved person must save on average
+	moves   int  // moves left
+	longest int  // longest commute of all placed persons
+	atMax   int  // persons at the longest
+	second  int  // next longest commute below it
+}
+
+// measure finds the longest commute of all placed persons, how many are at
+// it, and the next longest below it.
+func (r *rebalancer) measure() {
+	r.longest, r.atMax, r.second = 0, 0, 0
+	for i, j := range r.current {
+		if j == unassigned {
+			continue
+		}
+		switch s := r.seconds[i][j]; {
+		case s > r.longest:
+			r.second, r.longest, r.atMax = r.longest, s, 1
+		case s == r.longest:
+			r.atMax++
+		case s > r.second:
+			r.second = s
+		}
+	}
+}
+
+// together tells if person i at office j would share it with a person to
+// keep apart, leaving out person skip.
+func (r *rebalancer) together(i, j, skip int) bool {
+	for _, k := range r.apart[i] {
+		if k != skip && r.current[k] == j {
+			return true
+		}
+	}
+	return false
+}
+
+// gain scores a change of the persons from their offices to others: when
+// worst is set, the drop of the longest commute of all persons first, then
+// the seconds saved. ok is false when it saves too little, or when worst is
+// set and it moves nobody at the longest commute below it, as only that can
+// shorten it.
+func (r *rebalancer) gain(persons, to []int) (int, int, bool) {
+	after, atMax, saved := 0, 0, 0
+	for k, i := range persons {
+		old, next := r.seconds[i][r.current[i]], r.seconds[i][to[k]]
+		if next == no_route {
+			return 0, 0, false
+		}
+		if old == r.longest {
+			atMax++
+		}
+		if next > after {
+			after = next
+		}
+		saved += old - next
+	}
+	if saved < r.saving*len(persons) {
+		return 0, 0, false
+	}
+	if r.worst {
+		if atMax == 0 || after >= r.longest {
+			return 0, 0, false
+		}
+		if atMax < r.atMax {
+			// others stay at the longest, there are fewer of them
+			return 0, saved, true
+		}
+		longest := r.second
+		if after > longest {
+			longest = after
+		}
+		return r.longest - longest, saved, true
+	}
+	return 0, saved, true
+}
+
+// beats tells if the score a, b beats c, d.
+func beats(a, b, c, d int) bool {
+	return a > c || (a == c && b > d)
+}
+
+// step finds the best single move or swap and applies it, false when
+// nothing is left to improve within the moves left.
+func (r *rebalancer) step() ([]int, []int, bool) {
+	var best, bestTo []int
+	bestMax, bestSaved := 0, 0
+	if r.worst {
+		r.measure()
+	}
+	try := func(persons, to []int) {
+		max, saved, ok := r.gain(persons, to)
+		if ok && (best == nil || beats(max, saved, bestMax, bestSaved)) {
+			best, bestTo, bestMax, bestSaved = persons, to, max, saved
+		}
+	}
+	for i := range r.seconds {
+		if !r.movable[i] {
+			continue
+		}
+		for j := range r.left {
+			if j != r.current[i] && r.left[j] > 0 && !r.together(i, j, -1) {
+				try([]int{i}, []int{j})
+			}
+		}
+		if r.moves < 2 {
+			continue
+		}
+		for k := i + 1; k < len(r.seconds); k++ {
+			a, b := r.current[i], r.current[k]
+			if !r.movable[k] || a == b || r.together(i, b, k) || r.together(k, a, i) {
+				continue
+			}
+			try([]int{i, k}, []int{b, a})
+		}
+	}
+	if best == nil {
+		return nil, nil, false
+	}
+	from := make([]int, len(best))
+	for k, i := range best {
+		from[k] = r.current[i]
+		r.left[from[k]]++
+		r.left[bestTo[k]]--
+		r.current[i] = bestTo[k]
+	}
+	r.moves -= len(best)
+	return best, from, true
+}
+
+// rebalance plans moves and swaps from the current office of every person
+// that reduce the total commute, or the longest with the bottleneck and
+// minmax objectives. It makes at most MaxMoves moves, each saving at least
+// MinSaving minutes per person moved. Pinned and grouped persons stay and
+// apart pairs are not put together.
+func (m *Map) rebalance() error {
+	m.log.Infof("Rebalance from the current offices, at most %d moves", m.cfg.MaxMoves)
+	costs, err := m.buildCosts()
+	if err != nil {
+		return err
+	}
+	officeIndex := make(map[string]int, len(m.officeSlice))
+	for j, o := range m.officeSlice {
+		officeIndex[o.Name] = j
+	}
+	r := &rebalancer{
+		seconds: costs.Seconds,
+		current: make([]int, len(m.personSlice)),
+		left:    m.capacities(),
+		movable: make([]bool, len(m.personSlice)),
+		apart:   make([][]int, len(m.personSlice)),
+		worst:   m.cfg.Objective == objective_bottleneck || m.cfg.Objective == objective_minmax,
+		saving:  m.cfg.MinSaving * 60,
+		moves:   m.cfg.MaxMoves,
+	}
+	unknown, unrouted := 0, 0
+	for i, p := range m.personSlice {
+		j, ok := officeIndex[p.CurrentOffice]
+		if !ok {
+			r.current[i] = unassigned
+			if p.CurrentOffice != "" {
+				m.log.Warnf("Unknown current office %v of %v", p.CurrentOffice, p.Name)
+			}
+			unknown++
+			continue
+		}
+		r.current[i] = j
+		r.left[j]--
+		r.movable[i] = costs.Seconds[i][j] != no_route
+		if !r.movable[i] {
+			unrouted++
+		}
+	}
+	if unknown == len(m.personSlice) {
+		return fmt.Errorf("no person has a current office in column %c of %v", 'A'+sheet_person_current_index, sheet_person)
+	}
+	if unknown > 0 || unrouted > 0 {
+		m.log.Warnf("%d persons without a current office and %d without a route to it stay out of the plan", unknown, unrouted)
+	}
+	if c := m.loadConstraints(); c != nil {
+		for i := range c.Pins {
+			r.movable[i] = false
+		}
+		for _, group := range c.Groups {
+			for _, i := range group {
+				r.movable[i] = false
+			}
+		}
+		for _, pair := range c.Apart {
+			r.apart[pair[0]] = append(r.apart[pair[0]], pair[1])
+			r.apart[pair[1]] = append(r.apart[pair[1]], pair[0])
+		}
+	}
+
+	before := append([]int{}, r.current...)
+	moves := []Move{}
+	for step := 1; r.moves > 0; step++ {
+		persons, from, ok := r.step()
+		if !ok {
+			break
+		}
+		kind := "move"
+		if len(persons) == 2 {
+			kind = "swap"
+		}
+		for k, i := range persons {
+			old, next := costs.Seconds[i][from[k]]/60, costs.Seconds[i][r.current[i]]/60
+			moves = append(moves, Move{
+				Step:       step,
+				Kind:       kind,
+				Person:     m.personSlice[i].Name,
+				From:       m.officeSlice[from[k]].Name,
+				To:         m.officeSlice[r.current[i]].Name,
+				OldMinutes: old,
+				NewMinutes: next,
+				Saved:      old - next,
+			})
+		}
+	}
+	m.moves = moves
+	if m.run != nil {
+		m.run.Moves = moves
+	}
+	oldStats := objectiveStats("current", costs, before)
+	newStats := objectiveStats("rebalanced", costs, r.current)
+	printObjectives([]ObjectiveStats{oldStats, newStats})
+	fmt.Fprintf(os.Stdout, "%d moves, %d minutes saved\n", len(moves), oldStats.Total-newStats.Total)
+	for _, mv := range moves {
+		fmt.Fprintf(os.Stdout, "%3d %-4v %-12v %v -> %v, %d -> %d min\n", mv.Step, mv.Kind, mv.Person, mv.From, mv.To, mv.OldMinutes, mv.NewMinutes)
+	}
+	return nil
+}
+
+// fillRebalance writes the plan to its own sheet, one row per person moved.
+func (m *Map) fillRebalance() {
+	m.excelFile.DeleteSheet(sheet_rebalance)
+	m.excelFile.NewSheet(sheet_rebalance)
+	header := []interface{}{"step", "kind", "person", "old office", "new office", "old minutes", "new minutes", "minutes saved"}
+	m.excelFile.SetSheetRow(sheet_rebalance, "A1", &header)
+	for k, mv := range m.moves {
+		row := []interface{}{mv.Step, mv.Kind, mv.Person, mv.From, mv.To, mv.OldMinutes, mv.NewMinutes, mv.Saved}
+		m.excelFile.SetSheetRow(sheet_rebalance, "A"+strconv.Itoa(k+2), &row)
+	}
+}
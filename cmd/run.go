@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	run_status_running     = "running"
+	run_status_done        = "done"
+	run_status_failed      = "failed"
+	run_status_interrupted = "interrupted"
+
+	reason_new_person     = "new person"
+	reason_removed_person = "removed person"
+	reason_address_change = "address change"
+	reason_new_office     = "new office"
+	reason_office_removed = "office removed"
+	reason_office_moved   = "office address change"
+	reason_traffic        = "traffic"
+)
+
+// Run records one execution of the pipeline.
+type Run struct {
+	Id           primitive.ObjectID `bson:"_id,omitempty"`
+	Config       Config             `bson:"config"`
+	WorkbookHash string             `bson:"workbook_hash"`
+	Status       string             `bson:"status"`
+	StartedAt    time.Time          `bson:"started_at"`
+	FinishedAt   time.Time          `bson:"finished_at,omitempty"`
+	Summary      []StageSummary     `bson:"summary,omitempty"`
+	Objectives   []ObjectiveStats   `bson:"objectives,omitempty"`
+	Matching     *MatchingReport    `bson:"matching,omitempty"`
+	Moves        []Move             `bson:"moves,omitempty"`
+	Uncovered    []Uncovered        `bson:"uncovered,omitempty"`
+	Infeasible   []string           `bson:"infeasible,omitempty"` // constraints of the assignment not honoured
+}
+
+// PersonSnapshot is the ranking of a person as it was at the end of a run.
+type PersonSnapshot struct {
+	Id               primitive.ObjectID `bson:"_id,omitempty"`
+	RunId            primitive.ObjectID `bson:"run_id"`
+	PersonId         primitive.ObjectID `bson:"person_id,omitempty"`
+	Name             string             `bson:"name"`
+	Address          string             `bson:"address"`
+	Poi              Poi                `bson:"poi"`
+	NearestOffices   []string           `bson:"nearest_offices"`
+	NearestDurations []int              `bson:"nearest_durations"`
+	// NearestModes are the minutes per mode to each of the nearest offices.
+	NearestModes    []map[string]int `bson:"nearest_modes,omitempty"`
+	AssignedOffice  string           `bson:"assigned_office,omitempty"`
+	AssignedRank    int              `bson:"assigned_rank,omitempty"`
+	AssignedMinutes int              `bson:"assigned_minutes,omitempty"`
+}
+
+// OfficeSnapshot is the ranking of an office as it was at the end of a run.
+type OfficeSnapshot struct {
+	Id       primitive.ObjectID `bson:"_id,omitempty"`
+	RunId    primitive.ObjectID `bson:"run_id"`
+	OfficeId primitive.ObjectID `bson:"office_id,omitempty"`
+	Name     string             `bson:"name"`
+	Address  string             `bson:"address"`
+	Poi      Poi                `bson:"poi"`
+	SortList []Dummy            `bson:"sort_list"`
+	Capacity int                `bson:"capacity,omitempty"`
+	Assigned int                `bson:"assigned,omitempty"`
+}
+
+// RunDiff describes how the top office of a person changed between two runs.
+type RunDiff struct {
+	PersonName string
+	OfficeA    string
+	DurationA  int
+	OfficeB    string
+	DurationB  int
+	Reason     string
+}
+
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// redactMongoURL hides the password of a mongodb url.
+func redactMongoURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		return s
+	}
+	if r := strings.Replace(s, ":"+password+"@", ":"+redacted+"@", 1); r != s {
+		return r
+	}
+	// an escaped password
+	u.User = url.UserPassword(u.User.Username(), redacted)
+	return u.String()
+}
+
+// runConfig is the config saved on a run, without the credentials.
+func runConfig(cfg *Config) Config {
+	c := *cfg
+	c.MongoURL = redactMongoURL(c.MongoURL)
+	return c
+}
+
+func (m *Map) startRun() error {
+	hash, err := hashFile(m.cfg.ExcelFile)
+	if err != nil {
+		return fmt.Errorf("Can not hash %v, err: %v", m.cfg.ExcelFile, err)
+	}
+	run := &Run{
+		Id:           primitive.NewObjectID(),
+		Config:       runConfig(m.cfg),
+		WorkbookHash: hash,
+		Status:       run_status_running,
+		StartedAt:    time.Now(),
+	}
+	_, err = m.mongoCli.Database.Collection(mongo_collection_runs).InsertOne(m.ctx, run)
+	if err != nil {
+		return fmt.Errorf("Can not create run document, err: %v", err)
+	}
+	m.run = run
+	m.logFields.setRun(run.Id.Hex())
+	m.log.Infof("Start run %v", run.Id.Hex())
+	return nil
+}
+
+func (m *Map) finishRun(status string) {
+	if m.run == nil {
+		return
+	}
+	m.run.Status = status
+	m.run.FinishedAt = time.Now()
+	m.run.Summary = m.progress.Summary()
+	printSummary(os.Stdout, m.run.Summary)
+	_, err := m.mongoCli.Database.Collection(mongo_collection_runs).UpsertId(m.ctx, m.run.Id, m.run)
+	if err != nil {
+		m.log.Errorf("MongoDB updating fails for run %v, err: %v", m.run.Id.Hex(), err)
+	}
+	m.log.Infof("Run %v %v", m.run.Id.Hex(), status)
+}
+
+func (m *Map) failRun(err error) error {
+	m.finishRun(run_status_failed)
+	return err
+}
+
+// nearestModes returns the minutes per mode from every person to each of
+// their nearest offices.
+func (m *Map) nearestModes() ([][]map[string]int, error) {
+	durations := []PairDuration{}
+	err := m.durations().Find(m.ctx, m.workbookFilter()).Select(bson.M{"person_id": 1, "office_id": 1, "mode": 1, "seconds": 1}).All(&durations)
+	if err != nil {
+		return nil, err
+	}
+	minutes := map[primitive.ObjectID]map[primitive.ObjectID]map[string]int{}
+	for _, d := range durations {
+		if minutes[d.PersonId] == nil {
+			minutes[d.PersonId] = map[primitive.ObjectID]map[string]int{}
+		}
+		if minutes[d.PersonId][d.OfficeId] == nil {
+			minutes[d.PersonId][d.OfficeId] = map[string]int{}
+		}
+		minutes[d.PersonId][d.OfficeId][d.Mode] = d.Seconds / 60
+	}
+	officeIds := make(map[string]primitive.ObjectID, len(m.officeSlice))
+	for _, o := range m.officeSlice {
+		officeIds[o.Name] = o.Id
+	}
+	r := make([][]map[string]int, len(m.personSlice))
+	for i, p := range m.personSlice {
+		modes := m.personModes(p.CanDrive)
+		for _, office := range p.NearestOffices {
+			if office == "" {
+				break
+			}
+			byMode := map[string]int{}
+			for mode, v := range minutes[p.Id][officeIds[office]] {
+				if containsString(modes, mode) {
+					byMode[mode] = v
+				}
+			}
+			r[i] = append(r[i], byMode)
+		}
+	}
+	return r, nil
+}
+
+func (m *Map) saveSnapshot() error {
+	m.log.Infof("Save ranking snapshot for run %v", m.run.Id.Hex())
+	modes, err := m.nearestModes()
+	if err != nil {
+		return fmt.Errorf("Loading durations of the snapshot fails, err: %v", err)
+	}
+	persons := make([]PersonSnapshot, 0, len(m.personSlice))
+	for i, p := range m.personSlice {
+		persons = append(persons, PersonSnapshot{
+			RunId:            m.run.Id,
+			PersonId:         p.Id,
+			Name:             p.Name,
+			Address:          p.Address,
+			Poi:              p.Poi,
+			NearestOffices:   append([]string{}, p.NearestOffices[:]...),
+			NearestDurations: append([]int{}, p.NearestDurations[:]...),
+			NearestModes:     modes[i],
+			AssignedOffice:   p.AssignedOffice,
+			AssignedRank:     p.AssignedRank,
+			AssignedMinutes:  p.AssignedMinutes,
+		})
+	}
+	offices := make([]OfficeSnapshot, 0, len(m.officeSlice))
+	for _, o := range m.officeSlice {
+		offices = append(offices, OfficeSnapshot{
+			RunId:    m.run.Id,
+			OfficeId: o.Id,
+			Name:     o.Name,
+			Address:  o.Address,
+			Poi:      o.Poi,
+			SortList: o.SortList,
+			Capacity: o.Capacity,
+			Assigned: o.Assigned,
+		})
+	}
+	if len(persons) > 0 {
+		_, err := m.mongoCli.Database.Collection(mongo_collection_run_persons).InsertMany(m.ctx, persons)
+		if err != nil {
+			return fmt.Errorf("Saving person snapshot fails, err: %v", err)
+		}
+	}
+	if len(offices) > 0 {
+		_, err := m.mongoCli.Database.Collection(mongo_collection_run_offices).InsertMany(m.ctx, offices)
+		if err != nil {
+			return fmt.Errorf("Saving office snapshot fails, err: %v", err)
+		}
+	}
+	return nil
+}
+
+func (m *Map) loadSnapshot(runId primitive.ObjectID) ([]PersonSnapshot, []OfficeSnapshot, error) {
+	persons := []PersonSnapshot{}
+	err := m.mongoCli.Database.Collection(mongo_collection_run_persons).Find(m.ctx, bson.M{"run_id": runId}).All(&persons)
+	if err != nil {
+		return nil, nil, err
+	}
+	offices := []OfficeSnapshot{}
+	err = m.mongoCli.Database.Collection(mongo_collection_run_offices).Find(m.ctx, bson.M{"run_id": runId}).All(&offices)
+	if err != nil {
+		return nil, nil, err
+	}
+	return persons, offices, nil
+}
+
+func (m *Map) listRuns() error {
+	runs := []Run{}
+	err := m.mongoCli.Database.Collection(mongo_collection_runs).Find(m.ctx, bson.M{}).Sort("-started_at").All(&runs)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		hash := run.WorkbookHash
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\n", run.Id.Hex(), run.StartedAt.Format(time_format), run.Status, hash)
+	}
+	return nil
+}
+
+func (m *Map) diffRuns(a, b string) ([]RunDiff, error) {
+	idA, err := primitive.ObjectIDFromHex(a)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid run id %v, err: %v", a, err)
+	}
+	idB, err := primitive.ObjectIDFromHex(b)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid run id %v, err: %v", b, err)
+	}
+	personsA, officesA, err := m.loadSnapshot(idA)
+	if err != nil {
+		return nil, err
+	}
+	personsB, officesB, err := m.loadSnapshot(idB)
+	if err != nil {
+		return nil, err
+	}
+	if len(personsA) == 0 || len(personsB) == 0 {
+		return nil, fmt.Errorf("No snapshot for run %v or %v", a, b)
+	}
+	return diffSnapshots(personsA, officesA, personsB, officesB), nil
+}
+
+// diffSnapshots lists the persons whose top office or its duration changed
+// from snapshot A to B, and the persons only in one of them.
+func diffSnapshots(personsA []PersonSnapshot, officesA []OfficeSnapshot, personsB []PersonSnapshot, officesB []OfficeSnapshot) []RunDiff {
+	addrA := make(map[string]string, len(officesA))
+	for _, o := range officesA {
+		addrA[o.Name] = o.Address
+	}
+	addrB := make(map[string]string, len(officesB))
+	for _, o := range officesB {
+		addrB[o.Name] = o.Address
+	}
+	before := make(map[string]PersonSnapshot, len(personsA))
+	for _, p := range personsA {
+		before[p.Name] = p
+	}
+	after := make(map[string]bool, len(personsB))
+	for _, p := range personsB {
+		after[p.Name] = true
+	}
+
+	r := []RunDiff{}
+	for _, p := range personsB {
+		d := RunDiff{PersonName: p.Name}
+		if len(p.NearestOffices) > 0 {
+			d.OfficeB, d.DurationB = p.NearestOffices[0], p.NearestDurations[0]
+		}
+		old, ok := before[p.Name]
+		if !ok {
+			d.Reason = reason_new_person
+			r = append(r, d)
+			continue
+		}
+		if len(old.NearestOffices) > 0 {
+			d.OfficeA, d.DurationA = old.NearestOffices[0], old.NearestDurations[0]
+		}
+		if d.OfficeA == d.OfficeB && d.DurationA == d.DurationB {
+			continue
+		}
+		_, existedA := addrA[d.OfficeB]
+		_, existsB := addrB[d.OfficeA]
+		switch {
+		case old.Address != p.Address:
+			d.Reason = reason_address_change
+		case d.OfficeB != "" && !existedA:
+			d.Reason = reason_new_office
+		case d.OfficeA != "" && !existsB:
+			d.Reason = reason_office_removed
+		case addrA[d.OfficeA] != addrB[d.OfficeA] || addrA[d.OfficeB] != addrB[d.OfficeB]:
+			d.Reason = reason_office_moved
+		default:
+			d.Reason = reason_traffic
+		}
+		r = append(r, d)
+	}
+	for _, p := range personsA {
+		if after[p.Name] {
+			continue
+		}
+		d := RunDiff{PersonName: p.Name, Reason: reason_removed_person}
+		if len(p.NearestOffices) > 0 {
+			d.OfficeA, d.DurationA = p.NearestOffices[0], p.NearestDurations[0]
+		}
+		r = append(r, d)
+	}
+	return r
+}
+
+func (m *Map) showDiff(a, b string) error {
+	diffs, err := m.diffRuns(a, b)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Printf("%v: %v (%d) -> %v (%d), reason: %v\n", d.PersonName, d.OfficeA, d.DurationA, d.OfficeB, d.DurationB, d.Reason)
+	}
+	fmt.Printf("%d persons changed\n", len(diffs))
+	return nil
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	site_prefix          = "site:" // stored name of an office site of a scenario
+	office_kept          = "kept"
+	office_added         = "added"
+	office_removed       = "removed"
+	office_moved         = "moved"
+	sheet_scenario_total = "summary"
+)
+
+// ScenarioOffice is an office opened or moved by a scenario.
+type ScenarioOffice struct {
+	Name     string `json:"name"`
+	Address  string `json:"address"`
+	Capacity int    `json:"capacity"` // 0 keeps the capacity of a moved office
+}
+
+// Scenario changes the offices of the workbook, e.g.
+//
+//	{"name": "Q3", "remove": ["徐汇支行"], "add": [{"name": "漕河泾支行", "address": "..."}],
+//	 "move": [{"name": "静安支行", "address": "..."}]}
+type Scenario struct {
+	Name   string           `json:"name"`
+	Add    []ScenarioOffice `json:"add"`
+	Remove []string         `json:"remove"`
+	Move   []ScenarioOffice `json:"move"`
+}
+
+// outcome is where a person ends up: the assigned office with -assign,
+// the top office otherwise.
+type outcome struct {
+	Office  string
+	Minutes int
+}
+
+func readScenario(file string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("Can not parse scenario %v, err: %v", file, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	return s, nil
+}
+
+// site returns the stored office of a scenario address. Sites are stored
+// under their address rather than a workbook name, so a moved office never
+// touches the office of the workbook and the routes of a site are reused by
+// every scenario opening an office there.
+func (m *Map) site(address string) (Office, error) {
+	name := site_prefix + normalizeAddress(address)
+	o := Office{}
+	if err := m.mongoCli.Find(m.ctx, bson.M{"name": name}).One(&o); err == nil {
+		return o, nil
+	}
+	o = Office{Id: primitive.NewObjectID(), Name: name, Address: address}
+	return o, m.saveEntity(o.Id, o)
+}
+
+// applyScenario changes the offices of the workbook. The offices of sites
+// keep their stored name until they are routed, names maps them to the
+// name of the scenario.
+func (m *Map) applyScenario(s *Scenario) (map[string]string, map[string]string, error) {
+	status := map[string]string{}
+	names := map[string]string{}
+	index := map[string]int{}
+	for j, o := range m.officeSlice {
+		status[o.Name] = office_kept
+		index[o.Name] = j
+	}
+	removed := map[string]bool{}
+	for _, name := range s.Remove {
+		if _, ok := index[name]; !ok {
+			return nil, nil, fmt.Errorf("Can not remove %v, no such office", name)
+		}
+		removed[name] = true
+		status[name] = office_removed
+	}
+	for _, mo := range s.Move {
+		j, ok := index[mo.Name]
+		if !ok {
+			return nil, nil, fmt.Errorf("Can not move %v, no such office", mo.Name)
+		}
+		o, err := m.site(mo.Address)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := names[o.Name]; ok {
+			return nil, nil, fmt.Errorf("Can not move %v, another office of the scenario is at %v", mo.Name, mo.Address)
+		}
+		o.Capacity = m.officeSlice[j].Capacity
+		if mo.Capacity > 0 {
+			o.Capacity = mo.Capacity
+		}
+		m.officeSlice[j] = o
+		names[o.Name] = mo.Name
+		status[mo.Name] = office_moved
+	}
+	for _, ao := range s.Add {
+		if _, ok := status[ao.Name]; ok {
+			return nil, nil, fmt.Errorf("Can not add %v, the office exists", ao.Name)
+		}
+		o, err := m.site(ao.Address)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := names[o.Name]; ok {
+			return nil, nil, fmt.Errorf("Can not add %v, another office of the scenario is at %v", ao.Name, ao.Address)
+		}
+		o.Capacity = ao.Capacity
+		m.officeSlice = append(m.officeSlice, o)
+		names[o.Name] = ao.Name
+		status[ao.Name] = office_added
+	}
+	offices := []Office{}
+	for _, o := range m.officeSlice {
+		if !removed[o.Name] {
+			offices = append(offices, o)
+		}
+	}
+	m.officeSlice = offices
+	return status, names, m.entityWriter.Flush(m.ctx)
+}
+
+// evaluate ranks, and assigns with -assign, the persons to the offices
+// loaded, and returns the outcome of every person.
+func (m *Map) evaluate() ([]outcome, error) {
+	m.findOffices()
+	m.findPersons()
+	if m.cfg.Assign {
+		if err := m.assignOffices(); err != nil {
+			return nil, err
+		}
+	}
+	r := make([]outcome, len(m.personSlice))
+	for i, p := range m.personSlice {
+		if m.cfg.Assign {
+			r[i] = outcome{p.AssignedOffice, p.AssignedMinutes}
+		} else if p.NearestOffices[0] != "" {
+			r[i] = outcome{p.NearestOffices[0], p.NearestDurations[0]}
+		}
+	}
+	return r, nil
+}
+
+// runScenario compares a scenario with the workbook as it is. Durations of
+// the workbook come from the store, only the pairs of the new sites are
+// routed. The comparison is written next to the workbook.
+func (m *Map) runScenario(file string) error {
+	s, err := readScenario(file)
+	if err != nil {
+		return err
+	}
+	m.logFields.setStage(stage_load)
+	if err := m.loadExecelData(m.cfg.ExcelFile); err != nil {
+		return err
+	}
+	route := func() error {
+		m.logFields.setStage(stage_geocode)
+		if err := m.getAllPoi(); err != nil {
+			return err
+		}
+		m.logFields.setStage(stage_route)
+		return m.getAllDuration()
+	}
+	if err := route(); err != nil {
+		return err
+	}
+	m.logFields.setStage(stage_rank)
+	fmt.Fprintf(os.Stdout, "baseline\n")
+	baseline, err := m.evaluate()
+	if err != nil {
+		return err
+	}
+	capacity := map[string]int{}
+	for _, o := range m.officeSlice {
+		capacity[o.Name] = o.Capacity
+	}
+
+	m.log.Infof("Apply scenario %v: %d added, %d removed, %d moved", s.Name, len(s.Add), len(s.Remove), len(s.Move))
+	status, names, err := m.applyScenario(s)
+	if err != nil {
+		return err
+	}
+	if err := route(); err != nil {
+		return err
+	}
+	for j, o := range m.officeSlice {
+		if name, ok := names[o.Name]; ok {
+			m.officeSlice[j].Name = name
+		}
+		capacity[m.officeSlice[j].Name] = m.officeSlice[j].Capacity
+	}
+	m.logFields.setStage(stage_rank)
+	fmt.Fprintf(os.Stdout, "scenario %v\n", s.Name)
+	changed, err := m.evaluate()
+	if err != nil {
+		return err
+	}
+
+	out := scenarioFile(m.cfg.ExcelFile, s.Name)
+	m.logFields.setStage(stage_excel)
+	if err := m.writeScenario(out, s, baseline, changed, status, capacity); err != nil {
+		return err
+	}
+	m.log.Infof("Write scenario comparison to %v", out)
+	return nil
+}
+
+// scenarioFile names the comparison workbook of a scenario after the
+// workbook, e.g. data.scenario-north.xlsx for data.xlsx.
+func scenarioFile(workbook, name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, name)
+	return strings.TrimSuffix(workbook, filepath.Ext(workbook)) + ".scenario-" + name + filepath.Ext(workbook)
+}
+
+// writeScenario writes the comparison workbook: the persons whose office or
+// commute changes, the load of every office and the totals of both.
+func (m *Map) writeScenario(file string, s *Scenario, baseline, changed []outcome, status map[string]string, capacity map[string]int) error {
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", sheet_person)
+	f.NewSheet(sheet_office)
+	f.NewSheet(sheet_scenario_total)
+
+	header := []interface{}{"person", "baseline office", "baseline minutes", "scenario office", "scenario minutes", "change"}
+	f.SetSheetRow(sheet_person, "A1", &header)
+	affected := 0
+	for i, p := range m.personSlice {
+		a, b := baseline[i], changed[i]
+		if a == b {
+			continue
+		}
+		affected++
+		row := []interface{}{p.Name, a.Office, a.Minutes, b.Office, b.Minutes, b.Minutes - a.Minutes}
+		f.SetSheetRow(sheet_person, "A"+strconv.Itoa(affected+1), &row)
+	}
+
+	load := func(outcomes []outcome) map[string]int {
+		r := map[string]int{}
+		for _, o := range outcomes {
+			if o.Office != "" {
+				r[o.Office]++
+			}
+		}
+		return r
+	}
+	before, after := load(baseline), load(changed)
+	offices := make([]string, 0, len(status))
+	for name := range status {
+		offices = append(offices, name)
+	}
+	sort.Strings(offices)
+	header = []interface{}{"office", "status", "capacity", "baseline persons", "scenario persons", "change"}
+	f.SetSheetRow(sheet_office, "A1", &header)
+	for k, name := range offices {
+		row := []interface{}{name, status[name], capacity[name], before[name], after[name], after[name] - before[name]}
+		f.SetSheetRow(sheet_office, "A"+strconv.Itoa(k+2), &row)
+	}
+
+	total := func(outcomes []outcome) (int, int, int) {
+		sum, max, n := 0, 0, 0
+		for _, o := range outcomes {
+			if o.Office == "" {
+				continue
+			}
+			n++
+			sum += o.Minutes
+			if o.Minutes > max {
+				max = o.Minutes
+			}
+		}
+		return n, sum, max
+	}
+	n0, sum0, max0 := total(baseline)
+	n1, sum1, max1 := total(changed)
+	rows := [][]interface{}{
+		{"", "baseline", s.Name, "change"},
+		{"persons placed", n0, n1, n1 - n0},
+		{"total minutes", sum0, sum1, sum1 - sum0},
+		{"longest minutes", max0, max1, max1 - max0},
+		{"persons affected", "", affected, ""},
+	}
+	for k := range rows {
+		f.SetSheetRow(sheet_scenario_total, "A"+strconv.Itoa(k+1), &rows[k])
+	}
+	fmt.Fprintf(os.Stdout, "%v: %d persons affected, total %d -> %d min, longest %d -> %d min\n", s.Name, affected, sum0, sum1, max0, max1)
+	return f.SaveAs(file)
+}
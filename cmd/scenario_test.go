@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestScenarioFile(t *testing.T) {
+	tests := []struct {
+		workbook string
+		name     string
+		want     string
+	}{
+		{"data.xlsx", "data", "data.scenario-data.xlsx"},
+		{"dir/data.xlsx", "north", "dir/data.scenario-north.xlsx"},
+		{"data.xlsx", "../north", "data.scenario-.._north.xlsx"},
+	}
+	for _, tt := range tests {
+		if got := scenarioFile(tt.workbook, tt.name); got != tt.want {
+			t.Errorf("scenarioFile(%q, %q) = %q, want %q", tt.workbook, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"github.com/xuri/excelize/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	service_queued  = "queued"
+	service_running = "running"
+	service_done    = "done"
+	service_failed  = "failed"
+
+	max_upload       = 32 << 20
+	progress_tick    = time.Second
+	service_job_list = 50
+	workbook_name    = "workbook.xlsx"
+)
+
+// ServiceJob is a workbook submitted to the serve command. The pipeline
+// writes its results into the workbook, like it does for the cli.
+type ServiceJob struct {
+	Id         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	State      string             `bson:"state" json:"state"`
+	Config     Config             `bson:"config" json:"config"`
+	Upload     string             `bson:"upload" json:"upload"` // names of the uploaded files
+	Workbook   string             `bson:"workbook" json:"-"`
+	RunId      primitive.ObjectID `bson:"run_id,omitempty" json:"run_id,omitempty"`
+	Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+	Summary    []StageSummary     `bson:"summary,omitempty" json:"summary,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+	StartedAt  time.Time          `bson:"started_at,omitempty" json:"started_at,omitempty"`
+	FinishedAt time.Time          `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+type progressEvent struct {
+	State    string         `json:"state"`
+	Progress *ProgressState `json:"progress,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// service runs the queued jobs one after the other, as they share the rate
+// limit and the quota of the api key.
+type service struct {
+	m       *Map
+	wake    chan bool
+	lock    sync.Mutex
+	current primitive.ObjectID
+	running *Map
+}
+
+func (s *service) jobs() *qmgo.Collection {
+	return s.m.mongoCli.Database.Collection(mongo_collection_service_jobs)
+}
+
+// isLoopback tells if the listen address only accepts local connections.
+func isLoopback(listen string) bool {
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorize requires the token of the server from the clients, if it has
+// one. The dashboard passes it as a parameter, as browsers do not send
+// headers with EventSource and links.
+func (s *service) authorize(next http.Handler) http.Handler {
+	if s.m.cfg.Token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.m.cfg.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serve runs the http api until a signal stops it. The running job is put
+// back in the queue when it is interrupted, and resumes on the next start.
+// The queue only starts once the address is bound.
+func (m *Map) serve() error {
+	if m.cfg.Token == "" && !isLoopback(m.cfg.Listen) {
+		return fmt.Errorf("serving on %v needs a -token, the api spends the quota of the api key", m.cfg.Listen)
+	}
+	if err := os.MkdirAll(m.cfg.DataDir, 0755); err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", m.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	s := &service{m: m, wake: make(chan bool, 1)}
+	if err := s.jobs().EnsureIndexes(m.ctx, nil, []string{"state,created_at"}); err != nil {
+		m.log.Errorf("Creating service job indexes fails, err: %v", err)
+	}
+	// a job is only running while this process is, see runJob
+	requeued, err := s.jobs().UpdateAll(m.ctx, bson.M{"state": service_running}, bson.M{"$set": bson.M{"state": service_queued}})
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if requeued.ModifiedCount > 0 {
+		m.log.Infof("Requeue %d jobs of the previous server", requeued.ModifiedCount)
+	}
+
+	mux := http.NewServeMux()
+	api := http.NewServeMux()
+	api.HandleFunc("/jobs", s.handleJobs)
+	api.HandleFunc("/jobs/", s.handleJob)
+	api.Handle("/metrics", metrics)
+	api.HandleFunc("/api/query", s.handleQuery)
+	for _, path := range []string{"/jobs", "/jobs/", "/metrics", "/api/"} {
+		mux.Handle(path, s.authorize(api))
+	}
+	s.registerDashboard(mux, api)
+	server := &http.Server{Handler: mux}
+	go func() {
+		<-m.interrupted.Done()
+		ctx, cancel := context.WithTimeout(m.ctx, m.cfg.Grace)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+	queued := make(chan bool)
+	go func() {
+		defer close(queued)
+		s.runQueue()
+	}()
+	m.log.Infof("Serve on %v", listener.Addr())
+	err = server.Serve(listener)
+	if err != http.ErrServerClosed {
+		return err
+	}
+	<-queued
+	return nil
+}
+
+func (s *service) runQueue() {
+	for s.m.interrupted.Err() == nil {
+		job := ServiceJob{}
+		change := qmgo.Change{
+			Update:    bson.M{"$set": bson.M{"state": service_running, "started_at": time.Now()}},
+			ReturnNew: true,
+		}
+		err := s.jobs().Find(s.m.ctx, bson.M{"state": service_queued}).Sort("created_at").Apply(change, &job)
+		if err == nil {
+			s.runJob(job)
+			continue
+		}
+		if err != qmgo.ErrNoSuchDocuments {
+			s.m.log.Errorf("Taking a job from the queue fails, err: %v", err)
+		}
+		select {
+		case <-s.m.interrupted.Done():
+		case <-s.wake:
+		case <-time.After(s.m.cfg.Poll):
+		}
+	}
+}
+
+// runJob runs the pipeline of the cli for job.
+func (s *service) runJob(job ServiceJob) {
+	s.m.log.WithField("service_job_id", job.Id.Hex()).Infof("Run job %v", job.Id.Hex())
+	cfg := job.Config
+	cfg.AK, cfg.SK = s.m.cfg.AK, s.m.cfg.SK // never stored
+	cfg.MongoURL = s.m.cfg.MongoURL         // stored redacted
+	m := s.m.fork(&cfg)
+	s.lock.Lock()
+	s.current, s.running = job.Id, m
+	s.lock.Unlock()
+
+	err := m.runPipeline()
+	if ferr := m.flushWriters(); err == nil {
+		err = ferr
+	}
+	set := bson.M{"state": service_done, "finished_at": time.Now()}
+	if m.run != nil {
+		set["run_id"] = m.run.Id
+		set["summary"] = m.run.Summary
+	}
+	if err == errInterrupted {
+		set["state"] = service_queued
+	} else if err != nil {
+		set["state"] = service_failed
+		set["error"] = err.Error()
+	}
+	if err := s.jobs().UpdateId(s.m.ctx, job.Id, bson.M{"$set": set}); err != nil {
+		s.m.log.WithField("service_job_id", job.Id.Hex()).Errorf("Updating job %v fails, err: %v", job.Id.Hex(), err)
+	}
+
+	s.lock.Lock()
+	s.current, s.running = primitive.NilObjectID, nil
+	s.lock.Unlock()
+}
+
+// progress returns the progress of the job if it is running.
+func (s *service) progress(id primitive.ObjectID) *ProgressState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.current != id || s.running == nil {
+		return nil
+	}
+	state := s.running.progress.State()
+	return &state
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// handleJobs lists the jobs on GET and creates one on POST.
+func (s *service) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jobs := []ServiceJob{}
+		err := s.jobs().Find(r.Context(), bson.M{}).Sort("-created_at").Limit(service_job_list).All(&jobs)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		job, code, err := s.createJob(r)
+		if err != nil {
+			writeError(w, code, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, job)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+	}
+}
+
+// createJob stores the uploaded workbook, an .xlsx in the file field or
+// .csv files in the persons and offices fields, and queues a job for it.
+// The config field holds overrides of the server config in json.
+func (s *service) createJob(r *http.Request) (*ServiceJob, int, error) {
+	if err := r.ParseMultipartForm(max_upload); err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	job := &ServiceJob{Id: primitive.NewObjectID(), State: service_queued, CreatedAt: time.Now()}
+	dir := filepath.Join(s.m.cfg.DataDir, job.Id.Hex())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	job.Workbook = filepath.Join(dir, workbook_name)
+	upload, err := saveUpload(r, job.Workbook)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, http.StatusBadRequest, err
+	}
+	job.Upload = upload
+	cfg, err := s.jobConfig(r.FormValue("config"), job.Workbook)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, http.StatusBadRequest, err
+	}
+	job.Config = runConfig(cfg)
+	if _, err := s.jobs().InsertOne(r.Context(), job); err != nil {
+		os.RemoveAll(dir)
+		return nil, http.StatusInternalServerError, err
+	}
+	s.m.log.WithField("service_job_id", job.Id.Hex()).Infof("Queue job %v for %v", job.Id.Hex(), upload)
+	select {
+	case s.wake <- true:
+	default:
+	}
+	return job, http.StatusCreated, nil
+}
+
+// saveUpload writes the uploaded workbook to file and returns the names of
+// the uploaded files.
+func saveUpload(r *http.Request, file string) (string, error) {
+	if in, header, err := r.FormFile("file"); err == nil {
+		defer in.Close()
+		if strings.ToLower(filepath.Ext(header.Filename)) != ".xlsx" {
+			return "", fmt.Errorf("file must be an .xlsx workbook, upload csv files as persons and offices")
+		}
+		out, err := os.Create(file)
+		if err != nil {
+			return "", err
+		}
+		defer out.Close()
+		if _, err := io.Copy(out, in); err != nil {
+			return "", err
+		}
+		if err := out.Close(); err != nil {
+			return "", err
+		}
+		return header.Filename, checkWorkbook(file)
+	}
+	persons, personsHeader, err := r.FormFile("persons")
+	if err != nil {
+		return "", fmt.Errorf("upload a workbook as file, or csv files as persons and offices")
+	}
+	defer persons.Close()
+	offices, officesHeader, err := r.FormFile("offices")
+	if err != nil {
+		return "", fmt.Errorf("csv file of the offices is missing")
+	}
+	defer offices.Close()
+	if err := csvToWorkbook(persons, offices, file); err != nil {
+		return "", err
+	}
+	return personsHeader.Filename + ", " + officesHeader.Filename, checkWorkbook(file)
+}
+
+// csvToWorkbook writes the persons and offices csv files, with the columns
+// of their sheets, as a workbook.
+func csvToWorkbook(persons, offices io.Reader, file string) error {
+	f := excelize.NewFile()
+	f.SetSheetName(f.GetSheetName(0), sheet_person)
+	f.NewSheet(sheet_office)
+	for sheet, in := range map[string]io.Reader{sheet_person: persons, sheet_office: offices} {
+		reader := csv.NewReader(in)
+		reader.FieldsPerRecord = -1
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return fmt.Errorf("Can not read csv of %v, err: %v", sheet, err)
+		}
+		for i, row := range rows {
+			if i == 0 && len(row) > 0 {
+				row[0] = strings.TrimPrefix(row[0], "\ufeff")
+			}
+			if err := f.SetSheetRow(sheet, "A"+strconv.Itoa(i+1), &row); err != nil {
+				return err
+			}
+		}
+	}
+	return f.SaveAs(file)
+}
+
+func checkWorkbook(file string) error {
+	f, err := excelize.OpenFile(file)
+	if err != nil {
+		return fmt.Errorf("Can not load excel file, err: %v", err)
+	}
+	for _, sheet := range []string{sheet_person, sheet_office} {
+		if _, err := f.GetRows(sheet); err != nil {
+			return fmt.Errorf("Workbook needs a %v sheet, err: %v", sheet, err)
+		}
+	}
+	return nil
+}
+
+// jobOverrides are the settings of the server config a client may change
+// for its job, everything else is operational and stays as the server runs.
+type jobOverrides struct {
+	Region        *string  `json:"region"`
+	DepartAt      *string  `json:"depart_at"`
+	Modes         []string `json:"modes"`
+	MaxDistanceKm *float64 `json:"max_distance_km"`
+	Partial       *bool    `json:"partial"`
+	Assign        *bool    `json:"assign"`
+	Objective     *string  `json:"objective"`
+	CapMinutes    *int     `json:"cap_minutes"`
+	Compare       *bool    `json:"compare"`
+	Reach         *bool    `json:"reach"`
+	Rebalance     *bool    `json:"rebalance"`
+	MaxMoves      *int     `json:"max_moves"`
+	MinSaving     *int     `json:"min_saving"`
+}
+
+// jobConfig applies the overrides to the server config. Only the fields of
+// jobOverrides may be given.
+func (s *service) jobConfig(overrides, workbook string) (*Config, error) {
+	base := s.m.cfg
+	cfg := *base
+	cfg.Modes = append([]string{}, base.Modes...)
+	if overrides != "" {
+		o := jobOverrides{}
+		decoder := json.NewDecoder(strings.NewReader(overrides))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&o); err != nil {
+			return nil, fmt.Errorf("Invalid config, err: %v", err)
+		}
+		if o.Region != nil {
+			cfg.Region = *o.Region
+		}
+		if o.DepartAt != nil {
+			if _, err := time.Parse(time_format, *o.DepartAt); err != nil {
+				return nil, fmt.Errorf("Invalid config, depart_at must be like %v", time_format)
+			}
+			cfg.DepartAt = *o.DepartAt
+		}
+		if o.Modes != nil {
+			cfg.Modes = o.Modes
+		}
+		if o.MaxDistanceKm != nil {
+			cfg.MaxDistanceKm = *o.MaxDistanceKm
+		}
+		if o.Partial != nil {
+			cfg.Partial = *o.Partial
+		}
+		if o.Assign != nil {
+			cfg.Assign = *o.Assign
+		}
+		if o.Objective != nil {
+			cfg.Objective = *o.Objective
+		}
+		if o.CapMinutes != nil {
+			cfg.CapMinutes = *o.CapMinutes
+		}
+		if o.Compare != nil {
+			cfg.Compare = *o.Compare
+		}
+		if o.Reach != nil {
+			cfg.Reach = *o.Reach
+		}
+		if o.Rebalance != nil {
+			cfg.Rebalance = *o.Rebalance
+		}
+		if o.MaxMoves != nil {
+			cfg.MaxMoves = *o.MaxMoves
+		}
+		if o.MinSaving != nil {
+			cfg.MinSaving = *o.MinSaving
+		}
+	}
+	cfg.DryRun = false
+	cfg.ExcelFile = workbook
+	if len(cfg.Modes) == 0 {
+		return nil, fmt.Errorf("Invalid config, no modes")
+	}
+	for _, mode := range cfg.Modes {
+		if _, ok := path_map[mode]; !ok {
+			return nil, fmt.Errorf("Invalid config, unknown mode: %v", mode)
+		}
+	}
+	return &cfg, nil
+}
+
+// handleJob serves /jobs/{id}, /jobs/{id}/progress and /jobs/{id}/result.
+func (s *service) handleJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/"), "/")
+	id, err := primitive.ObjectIDFromHex(parts[0])
+	if err != nil || len(parts) > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such job"))
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+		return
+	}
+	job := ServiceJob{}
+	if err := s.jobs().Find(r.Context(), bson.M{"_id": id}).One(&job); err != nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such job"))
+		return
+	}
+	if len(parts) == 1 {
+		writeJSON(w, http.StatusOK, job)
+		return
+	}
+	switch parts[1] {
+	case "progress":
+		s.streamProgress(w, r, job)
+	case "result":
+		s.writeResult(w, r, job)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such resource"))
+	}
+}
+
+// streamProgress sends the state of the job as server-sent events until it
+// is done or failed.
+func (s *service) streamProgress(w http.ResponseWriter, r *http.Request, job ServiceJob) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("streaming is not supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(progress_tick)
+	defer ticker.Stop()
+	for {
+		data, _ := json.Marshal(progressEvent{State: job.State, Progress: s.progress(job.Id), Error: job.Error})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		if job.State == service_done || job.State == service_failed {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.jobs().Find(r.Context(), bson.M{"_id": job.Id}).One(&job); err != nil {
+			return
+		}
+	}
+}
+
+// writeResult sends the result workbook, or the rankings of the run in
+// json with format=json.
+func (s *service) writeResult(w http.ResponseWriter, r *http.Request, job ServiceJob) {
+	if job.State != service_done {
+		writeError(w, http.StatusConflict, fmt.Errorf("job is %v", job.State))
+		return
+	}
+	if r.URL.Query().Get("format") == "json" {
+		persons, offices, err := s.m.loadSnapshot(job.RunId)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"run_id": job.RunId, "persons": persons, "offices": offices})
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", job.Id.Hex()+".xlsx"))
+	http.ServeFile(w, r, job.Workbook)
+}
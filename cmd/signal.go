@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var errInterrupted = errors.New("interrupted by signal")
+
+// handleSignals implements a graceful shutdown. The first SIGINT/SIGTERM
+// stops scheduling new work and gives in-flight calls m.cfg.Grace to finish,
+// completed results are still flushed to the store. A second signal aborts
+// everything, including store writes.
+func (m *Map) handleSignals(stopScheduling, cancelCalls, cancelAll context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	m.log.Warnf("Received %v, stop scheduling new work, in-flight calls have %v to finish", sig, m.cfg.Grace)
+	stopScheduling()
+	timer := time.AfterFunc(m.cfg.Grace, func() {
+		m.log.Warnf("In-flight calls did not finish in %v, cancel them", m.cfg.Grace)
+		cancelCalls()
+	})
+	sig = <-sigs
+	timer.Stop()
+	m.log.Errorf("Received %v again, abort", sig)
+	cancelCalls()
+	cancelAll()
+}
+
+// interruptErr returns errInterrupted once a signal stopped the scheduling.
+func (m *Map) interruptErr() error {
+	if m.interrupted.Err() != nil {
+		return errInterrupted
+	}
+	return nil
+}
+
+// isReleased tells whether a route failed only because of the shutdown, in
+// which case its job goes back to pending instead of counting an attempt.
+func isReleased(err error) bool {
+	return errors.Is(err, errInterrupted) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	sheet_candidates               = "candidates" // name, address, capacity of candidate sites
+	sheet_candidate_capacity_index = 2
+	sheet_sites                    = "sites"
+	location_median                = "median" // least total commute
+	location_center                = "center" // least longest commute
+	site_fixed                     = "fixed"
+	site_chosen                    = "chosen"
+	site_rejected                  = "rejected"
+	swap_rounds                    = 50 // rounds of the interchange search
+)
+
+// siteScore ranks sets of open sites: fewer persons without a site first,
+// then the objective, then the total.
+type siteScore struct {
+	Unassigned int
+	Value      int
+	Total      int
+}
+
+func (a siteScore) less(b siteScore) bool {
+	if a.Unassigned != b.Unassigned {
+		return a.Unassigned < b.Unassigned
+	}
+	if a.Value != b.Value {
+		return a.Value < b.Value
+	}
+	return a.Total < b.Total
+}
+
+// siteSolver chooses sites among candidates for persons with the commutes
+// in seconds. Capacities are only used when some site has one.
+type siteSolver struct {
+	seconds    [][]int
+	capacity   []int // 0 for no limit
+	center     bool
+	capacitate bool
+}
+
+// assign places the persons at the open sites and scores it.
+func (s *siteSolver) assign(open []int) ([]int, siteScore) {
+	assigned := make([]int, len(s.seconds))
+	if s.capacitate {
+		seconds := make([][]int, len(s.seconds))
+		for i := range seconds {
+			seconds[i] = make([]int, len(open))
+			for k, j := range open {
+				seconds[i][k] = s.seconds[i][j]
+			}
+		}
+		capacity := make([]int, len(open))
+		for k, j := range open {
+			capacity[k] = s.capacity[j]
+			if capacity[k] <= 0 {
+				capacity[k] = len(s.seconds)
+			}
+		}
+		var local []int
+		if s.center {
+			local, _ = solveBottleneck(seconds, capacity, nil)
+		} else {
+			local = solveMinCost(seconds, capacity, nil)
+		}
+		for i, k := range local {
+			assigned[i] = unassigned
+			if k != unassigned {
+				assigned[i] = open[k]
+			}
+		}
+	} else {
+		for i, row := range s.seconds {
+			assigned[i] = unassigned
+			for _, j := range open {
+				if row[j] != no_route && (assigned[i] == unassigned || row[j] < row[assigned[i]]) {
+					assigned[i] = j
+				}
+			}
+		}
+	}
+	score := siteScore{}
+	for i, j := range assigned {
+		if j == unassigned {
+			score.Unassigned++
+			continue
+		}
+		score.Total += s.seconds[i][j]
+		if s.seconds[i][j] > score.Value {
+			score.Value = s.seconds[i][j]
+		}
+	}
+	if !s.center {
+		score.Value = score.Total
+	}
+	return assigned, score
+}
+
+// choose opens k of the candidates next to the fixed sites: greedily one by
+// one, then by swapping an open candidate with a closed one as long as it
+// improves the score.
+func (s *siteSolver) choose(fixed, candidates []int, k int) []int {
+	open := append([]int{}, fixed...)
+	closed := append([]int{}, candidates...)
+	for n := 0; n < k; n++ {
+		best, bestScore := -1, siteScore{}
+		for c, j := range closed {
+			_, score := s.assign(append(open, j))
+			if best < 0 || score.less(bestScore) {
+				best, bestScore = c, score
+			}
+		}
+		open = append(open, closed[best])
+		closed = append(closed[:best], closed[best+1:]...)
+	}
+	_, current := s.assign(open)
+	for round := 0; round < swap_rounds; round++ {
+		improved := false
+		for a := len(fixed); a < len(open) && !improved; a++ {
+			for c := range closed {
+				open[a], closed[c] = closed[c], open[a]
+				if _, score := s.assign(open); score.less(current) {
+					current, improved = score, true
+					break
+				}
+				open[a], closed[c] = closed[c], open[a]
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return open
+}
+
+// readCandidates reads the candidate sites of the workbook.
+func (m *Map) readCandidates() ([]Office, error) {
+	r := []Office{}
+	names := map[string]bool{}
+	for _, o := range m.officeSlice {
+		names[o.Name] = true
+	}
+	// candidates are routed under their normalized address, see chooseSites
+	addresses := map[string]string{}
+	// cells in their columns, as the capacity may be empty
+	for _, row := range m.readColumns(sheet_candidates) {
+		if len(row) < 2 || row[0] == "" || row[1] == "" {
+			m.log.Warnf("No name or address for candidate %v", row)
+			continue
+		}
+		if names[row[0]] {
+			return nil, fmt.Errorf("Candidate %v has the name of another office", row[0])
+		}
+		names[row[0]] = true
+		address := normalizeAddress(row[1])
+		if other, ok := addresses[address]; ok {
+			return nil, fmt.Errorf("Candidates %v and %v have the same address %v", other, row[0], row[1])
+		}
+		addresses[address] = row[0]
+		o, err := m.site(row[1])
+		if err != nil {
+			return nil, err
+		}
+		o.Capacity, err = readCapacity(row, sheet_candidate_capacity_index)
+		if err != nil {
+			return nil, fmt.Errorf("Can not read the capacity of candidate %v, err: %v", row[0], err)
+		}
+		o.Name = row[0]
+		r = append(r, o)
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no candidate in the %v sheet", sheet_candidates)
+	}
+	return r, m.entityWriter.Flush(m.ctx)
+}
+
+// keptOffices returns the offices of the workbook named by -keep.
+func (m *Map) keptOffices() ([]Office, error) {
+	if m.cfg.Keep == "" {
+		return []Office{}, nil
+	}
+	if m.cfg.Keep == "all" {
+		return m.officeSlice, nil
+	}
+	index := map[string]int{}
+	for j, o := range m.officeSlice {
+		index[o.Name] = j
+	}
+	r := []Office{}
+	for _, name := range strings.Split(m.cfg.Keep, ",") {
+		j, ok := index[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("Can not keep %v, no such office", name)
+		}
+		r = append(r, m.officeSlice[j])
+	}
+	return r, nil
+}
+
+// chooseSites picks the K best candidate sites of the workbook, for the
+// least total commute (p-median) or the least longest one (p-center),
+// with the capacities of the candidates sheet and the offices kept open.
+func (m *Map) chooseSites() error {
+	if m.cfg.Location != location_median && m.cfg.Location != location_center {
+		return fmt.Errorf("unknown location objective: %v", m.cfg.Location)
+	}
+	m.logFields.setStage(stage_load)
+	if err := m.loadExecelData(m.cfg.ExcelFile); err != nil {
+		return err
+	}
+	kept, err := m.keptOffices()
+	if err != nil {
+		return err
+	}
+	candidates, err := m.readCandidates()
+	if err != nil {
+		return err
+	}
+	if m.cfg.K <= 0 || m.cfg.K > len(candidates) {
+		return fmt.Errorf("can not choose %d of %d candidates", m.cfg.K, len(candidates))
+	}
+	// sites are routed under their stored names, see site
+	m.officeSlice = append(append([]Office{}, kept...), candidates...)
+	names := make([]string, len(m.officeSlice))
+	for j := range m.officeSlice {
+		names[j] = m.officeSlice[j].Name
+		if j >= len(kept) {
+			m.officeSlice[j].Name = site_prefix + normalizeAddress(m.officeSlice[j].Address)
+		}
+	}
+	m.logFields.setStage(stage_geocode)
+	if err := m.getAllPoi(); err != nil {
+		return err
+	}
+	m.logFields.setStage(stage_route)
+	if err := m.getAllDuration(); err != nil {
+		return err
+	}
+	for j := range m.officeSlice {
+		m.officeSlice[j].Name = names[j]
+	}
+
+	m.logFields.setStage(stage_assign)
+	costs, err := m.buildCosts()
+	if err != nil {
+		return err
+	}
+	s := &siteSolver{seconds: costs.Seconds, capacity: make([]int, len(m.officeSlice)), center: m.cfg.Location == location_center}
+	for j, o := range m.officeSlice {
+		s.capacity[j] = o.Capacity
+		s.capacitate = s.capacitate || o.Capacity > 0
+	}
+	fixed, open := []int{}, []int{}
+	for j := range kept {
+		fixed = append(fixed, j)
+	}
+	for j := len(kept); j < len(m.officeSlice); j++ {
+		open = append(open, j)
+	}
+	m.log.Infof("Choose %d of %d candidates, p-%v, %d offices kept", m.cfg.K, len(candidates), m.cfg.Location, len(kept))
+	chosen := s.choose(fixed, open, m.cfg.K)
+	assigned, score := s.assign(chosen)
+	m.applyAssignment(costs, assigned)
+	return m.writeSites(costs, chosen, len(kept), score)
+}
+
+// writeSites prints the chosen sites and writes them with the assignment
+// to a workbook next to the input one.
+func (m *Map) writeSites(costs *Costs, chosen []int, kept int, score siteScore) error {
+	isOpen := map[int]bool{}
+	for _, j := range chosen {
+		isOpen[j] = true
+	}
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", sheet_sites)
+	f.NewSheet(sheet_person)
+	header := []interface{}{"site", "address", "status", "capacity", "persons", "mean minutes", "max minutes"}
+	f.SetSheetRow(sheet_sites, "A1", &header)
+	minutes := make([][]int, len(m.officeSlice))
+	for _, p := range m.personSlice {
+		for j, o := range m.officeSlice {
+			if p.AssignedOffice == o.Name {
+				minutes[j] = append(minutes[j], p.AssignedMinutes)
+			}
+		}
+	}
+	order := make([]int, len(m.officeSlice))
+	for j := range order {
+		order[j] = j
+	}
+	sort.SliceStable(order, func(a, b int) bool { return isOpen[order[a]] && !isOpen[order[b]] })
+	fmt.Fprintf(os.Stdout, "%-20v %-8v %8v %8v %6v\n", "site", "status", "persons", "mean", "max")
+	for k, j := range order {
+		o := m.officeSlice[j]
+		status := site_rejected
+		if j < kept {
+			status = site_fixed
+		} else if isOpen[j] {
+			status = site_chosen
+		}
+		mean, max := 0.0, 0
+		for _, v := range minutes[j] {
+			mean += float64(v)
+			if v > max {
+				max = v
+			}
+		}
+		if len(minutes[j]) > 0 {
+			mean /= float64(len(minutes[j]))
+		}
+		row := []interface{}{o.Name, o.Address, status, o.Capacity, len(minutes[j]), mean, max}
+		f.SetSheetRow(sheet_sites, "A"+strconv.Itoa(k+2), &row)
+		if isOpen[j] {
+			fmt.Fprintf(os.Stdout, "%-20v %-8v %8d %8.1f %6d\n", o.Name, status, len(minutes[j]), mean, max)
+		}
+	}
+	fmt.Fprintf(os.Stdout, "%d persons placed, %d without a site, total %d min, longest %d min\n",
+		len(m.personSlice)-score.Unassigned, score.Unassigned, score.Total/60, maxAssigned(m.personSlice))
+
+	header = []interface{}{"person", "site", "minutes", "mode"}
+	f.SetSheetRow(sheet_person, "A1", &header)
+	officeIndex := map[string]int{}
+	for j, o := range m.officeSlice {
+		officeIndex[o.Name] = j
+	}
+	for i, p := range m.personSlice {
+		row := []interface{}{p.Name, "", "", ""}
+		if j, ok := officeIndex[p.AssignedOffice]; ok {
+			row = []interface{}{p.Name, p.AssignedOffice, p.AssignedMinutes, costs.Modes[i][j]}
+		}
+		f.SetSheetRow(sheet_person, "A"+strconv.Itoa(i+2), &row)
+	}
+	file := strings.TrimSuffix(m.cfg.ExcelFile, filepath.Ext(m.cfg.ExcelFile)) + ".sites" + filepath.Ext(m.cfg.ExcelFile)
+	m.log.Infof("Write chosen sites to %v", file)
+	return f.SaveAs(file)
+}
+
+func maxAssigned(persons []Person) int {
+	r := 0
+	for _, p := range persons {
+		if p.AssignedOffice != "" && p.AssignedMinutes > r {
+			r = p.AssignedMinutes
+		}
+	}
+	return r
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestSiteSolverChoose(t *testing.T) {
+	seconds := [][]int{{10, 80, 40}, {10, 80, 40}, {90, 10, 40}}
+	tests := []struct {
+		name       string
+		center     bool
+		capacity   []int
+		fixed      []int
+		candidates []int
+		k          int
+		want       []int
+	}{
+		{"median", false, []int{0, 0, 0}, nil, []int{0, 1, 2}, 1, []int{0}},
+		{"center", true, []int{0, 0, 0}, nil, []int{0, 1, 2}, 1, []int{2}},
+		{"next to a kept site", false, []int{0, 0, 0}, []int{0}, []int{1, 2}, 1, []int{0, 1}},
+		{"capacity", true, []int{0, 0, 1}, nil, []int{1, 2}, 1, []int{1}},
+		{"all", false, []int{0, 0, 0}, nil, []int{0, 1, 2}, 3, []int{0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &siteSolver{seconds: seconds, capacity: tt.capacity, center: tt.center}
+			for _, c := range tt.capacity {
+				s.capacitate = s.capacitate || c > 0
+			}
+			got := s.choose(tt.fixed, tt.candidates, tt.k)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("choose() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadColumns(t *testing.T) {
+	f := excelize.NewFile()
+	f.NewSheet(sheet_candidates)
+	rows := [][]interface{}{
+		{"name", "address", "capacity", "cluster"},
+		{"north", "road 1", "", "2"},
+		{},
+		{" south ", " road 2 ", "10"},
+	}
+	for k, row := range rows {
+		cell, _ := excelize.CoordinatesToCellName(1, k+1)
+		f.SetSheetRow(sheet_candidates, cell, &row)
+	}
+	m := &Map{excelFile: f}
+	want := [][]string{{"north", "road 1", "", "2"}, {"south", "road 2", "10"}}
+	got := m.readColumns(sheet_candidates)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("readColumns() = %q, want %q", got, want)
+	}
+	if capacity, err := readCapacity(got[0], sheet_candidate_capacity_index); capacity != 0 || err != nil {
+		t.Errorf("readCapacity() of an empty cell = %v, %v, want 0", capacity, err)
+	}
+	if got := m.readRows(sheet_candidates); !reflect.DeepEqual(got, [][]string{{"north", "road 1", "2"}, {"south", "road 2", "10"}}) {
+		t.Errorf("readRows() = %q", got)
+	}
+	if got := m.readColumns("missing"); len(got) != 0 {
+		t.Errorf("readColumns() of a missing sheet = %q", got)
+	}
+}
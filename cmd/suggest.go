@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xuri/excelize/v2"
+)
+
+const (
+	cluster_kmeans      = "kmeans"
+	cluster_kmedoids    = "kmedoids"
+	default_radius      = 2000 // metres searched around a cluster centre
+	default_place_query = "写字楼"
+	suggest_per_cluster = 3 // candidate sites kept per cluster
+	cluster_iterations  = 100
+	sheet_clusters      = "clusters"
+	km_per_lat          = 110.57
+	km_per_lng          = 111.32 // at the equator
+)
+
+// weightedPoi is a location with the number of persons living there.
+type weightedPoi struct {
+	Poi    Poi
+	Weight float64
+}
+
+// Cluster is a group of persons living near each other.
+type Cluster struct {
+	Persons []int
+	Centre  Poi // mean for k-means, medoid for k-medoids
+	Median  Poi // weighted geometric median, searched around for sites
+}
+
+// weightedPois merges the persons living at the same poi, persons without
+// one are left out.
+func weightedPois(persons []Person) ([]weightedPoi, [][]int) {
+	index := map[Poi]int{}
+	r, members := []weightedPoi{}, [][]int{}
+	for i, p := range persons {
+		if isZeroPoi(p.Poi) {
+			continue
+		}
+		k, ok := index[p.Poi]
+		if !ok {
+			k = len(r)
+			index[p.Poi] = k
+			r = append(r, weightedPoi{Poi: p.Poi})
+			members = append(members, nil)
+		}
+		r[k].Weight++
+		members[k] = append(members[k], i)
+	}
+	return r, members
+}
+
+// geometricMedian returns the point with the least weighted sum of
+// distances to the points, by Weiszfeld's iteration on a local plane.
+func geometricMedian(points []weightedPoi) Poi {
+	if len(points) == 0 {
+		return Poi{}
+	}
+	cos := math.Cos(points[0].Poi.Lat * math.Pi / 180)
+	x, y, w := 0.0, 0.0, 0.0
+	for _, p := range points {
+		x += p.Weight * p.Poi.Lng
+		y += p.Weight * p.Poi.Lat
+		w += p.Weight
+	}
+	x, y = x/w, y/w
+	for it := 0; it < cluster_iterations; it++ {
+		nx, ny, nw := 0.0, 0.0, 0.0
+		for _, p := range points {
+			d := math.Hypot((p.Poi.Lng-x)*cos*km_per_lng, (p.Poi.Lat-y)*km_per_lat)
+			if d < 1e-6 {
+				// on a point, which is as good as it gets
+				continue
+			}
+			nx += p.Weight * p.Poi.Lng / d
+			ny += p.Weight * p.Poi.Lat / d
+			nw += p.Weight / d
+		}
+		if nw == 0 {
+			break
+		}
+		nx, ny = nx/nw, ny/nw
+		moved := math.Hypot((nx-x)*cos*km_per_lng, (ny-y)*km_per_lat)
+		x, y = nx, ny
+		if moved < 0.001 {
+			break
+		}
+	}
+	return Poi{Lat: y, Lng: x}
+}
+
+// seedCentres picks k distinct points by k-means++, seeded so that runs on
+// the same persons give the same clusters.
+func seedCentres(points []weightedPoi, k int) []Poi {
+	rnd := rand.New(rand.NewSource(1))
+	centres := []Poi{points[rnd.Intn(len(points))].Poi}
+	for len(centres) < k {
+		weights := make([]float64, len(points))
+		sum := 0.0
+		for i, p := range points {
+			d := math.MaxFloat64
+			for _, c := range centres {
+				d = math.Min(d, distanceKm(p.Poi, c))
+			}
+			weights[i] = p.Weight * d * d
+			sum += weights[i]
+		}
+		if sum == 0 {
+			break
+		}
+		r := rnd.Float64() * sum
+		for i, w := range weights {
+			if r -= w; r <= 0 || i == len(weights)-1 {
+				centres = append(centres, points[i].Poi)
+				break
+			}
+		}
+	}
+	return centres
+}
+
+// nearestCentres returns the index of the nearest centre of every point.
+func nearestCentres(points []weightedPoi, centres []Poi) []int {
+	r := make([]int, len(points))
+	for i, p := range points {
+		for c := range centres {
+			if distanceKm(p.Poi, centres[c]) < distanceKm(p.Poi, centres[r[i]]) {
+				r[i] = c
+			}
+		}
+	}
+	return r
+}
+
+// clusterPois groups the points around k centres, by weighted k-means or
+// by k-medoids where every centre is one of the points.
+func clusterPois(points []weightedPoi, k int, medoids bool) ([]Poi, []int) {
+	centres := seedCentres(points, k)
+	labels := nearestCentres(points, centres)
+	for it := 0; it < cluster_iterations; it++ {
+		for c := range centres {
+			members := []weightedPoi{}
+			for i, l := range labels {
+				if l == c {
+					members = append(members, points[i])
+				}
+			}
+			if len(members) == 0 {
+				continue
+			}
+			if !medoids {
+				lat, lng, w := 0.0, 0.0, 0.0
+				for _, p := range members {
+					lat += p.Weight * p.Poi.Lat
+					lng += p.Weight * p.Poi.Lng
+					w += p.Weight
+				}
+				centres[c] = Poi{Lat: lat / w, Lng: lng / w}
+				continue
+			}
+			best := math.MaxFloat64
+			for _, candidate := range members {
+				sum := 0.0
+				for _, p := range members {
+					sum += p.Weight * distanceKm(candidate.Poi, p.Poi)
+				}
+				if sum < best {
+					best, centres[c] = sum, candidate.Poi
+				}
+			}
+		}
+		next := nearestCentres(points, centres)
+		stable := true
+		for i := range next {
+			stable = stable && next[i] == labels[i]
+		}
+		labels = next
+		if stable {
+			break
+		}
+	}
+	return centres, labels
+}
+
+// searchPlaces searches the places matching query within radius metres of
+// a poi with the baidu place api.
+func (m *Map) searchPlaces(ctx context.Context, query string, centre Poi, radius int) ([]PlaceRespResult, error) {
+	if err := m.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	m.progress.Call("")
+	path := fmt.Sprintf(place_nearby, url.QueryEscape(query), fmt.Sprintf("%f", centre.Lat), fmt.Sprintf("%f", centre.Lng), radius) + m.cfg.AK
+	sn := generateSN(path, m.cfg.SK)
+	start := time.Now()
+	resp, err := m.restyClient.R().SetContext(ctx).Get(host + path + "&sn=" + sn)
+	if err != nil {
+		observeRequest("place", start, "error")
+		return nil, redactError(err)
+	}
+	var placeResp PlaceResp
+	if err := json.Unmarshal(resp.Body(), &placeResp); err != nil {
+		observeRequest("place", start, fmt.Sprintf("http_%d", resp.StatusCode()))
+		return nil, fmt.Errorf("Parse resp data fails, err: %v", err)
+	}
+	observeRequest("place", start, strconv.Itoa(placeResp.Status))
+	if placeResp.Status != 0 {
+		return nil, &apiError{
+			Status:  placeResp.Status,
+			Message: placeResp.Message,
+			err:     fmt.Errorf("Can not search places from server, message: %v", placeResp.Message),
+		}
+	}
+	return placeResp.Results, nil
+}
+
+// suggestion is a candidate site found near a cluster.
+type suggestion struct {
+	Office  Office
+	Cluster int
+	Km      float64 // from the cluster median
+}
+
+// suggestSites clusters the persons, searches for buildings near the median
+// of every cluster and routes every person to them. The candidates are
+// written in the layout of the candidates sheet of the sites command.
+func (m *Map) suggestSites() error {
+	if m.cfg.Cluster != cluster_kmeans && m.cfg.Cluster != cluster_kmedoids {
+		return fmt.Errorf("unknown clustering: %v", m.cfg.Cluster)
+	}
+	m.logFields.setStage(stage_load)
+	if err := m.loadExecelData(m.cfg.ExcelFile); err != nil {
+		return err
+	}
+	m.logFields.setStage(stage_geocode)
+	if err := m.getAllPoi(); err != nil {
+		return err
+	}
+	points, members := weightedPois(m.personSlice)
+	if len(points) == 0 {
+		return fmt.Errorf("no person has a poi")
+	}
+	k := m.cfg.K
+	if k <= 0 || k > len(points) {
+		return fmt.Errorf("can not make %d clusters of %d locations", k, len(points))
+	}
+	centres, labels := clusterPois(points, k, m.cfg.Cluster == cluster_kmedoids)
+	k = len(centres)
+	clusters := make([]Cluster, k)
+	for c := range clusters {
+		clusters[c].Centre = centres[c]
+		group := []weightedPoi{}
+		for i, l := range labels {
+			if l == c {
+				group = append(group, points[i])
+				clusters[c].Persons = append(clusters[c].Persons, members[i]...)
+			}
+		}
+		clusters[c].Median = geometricMedian(group)
+	}
+	all := geometricMedian(points)
+	m.log.Infof("%d clusters by %v, median of everybody at %f,%f", k, m.cfg.Cluster, all.Lat, all.Lng)
+
+	suggestions := []suggestion{}
+	seen := map[string]bool{} // normalized addresses, sites are routed under them
+	for c, cluster := range clusters {
+		if len(cluster.Persons) == 0 {
+			continue
+		}
+		places, err := m.searchPlaces(m.interrupted, m.cfg.PlaceQuery, cluster.Median, m.cfg.Radius)
+		if err != nil {
+			m.log.Errorf("Searching %v near cluster %d fails, err: %v", m.cfg.PlaceQuery, c+1, err)
+			continue
+		}
+		sort.SliceStable(places, func(a, b int) bool {
+			return distanceKm(places[a].Location, cluster.Median) < distanceKm(places[b].Location, cluster.Median)
+		})
+		n := 0
+		for _, p := range places {
+			address := p.Address
+			if address == "" {
+				address = p.Name
+			}
+			if n == suggest_per_cluster || seen[normalizeAddress(address)] || isZeroPoi(p.Location) {
+				continue
+			}
+			seen[normalizeAddress(address)] = true
+			n++
+			o, err := m.site(address)
+			if err != nil {
+				return err
+			}
+			if isZeroPoi(o.Poi) {
+				o.Poi = p.Location
+				if err := m.saveEntity(o.Id, o); err != nil {
+					return err
+				}
+			}
+			suggestions = append(suggestions, suggestion{Office: o, Cluster: c, Km: distanceKm(o.Poi, cluster.Median)})
+			suggestions[len(suggestions)-1].Office.Name = p.Name
+		}
+		if n == 0 {
+			m.log.Warnf("No %v within %d m of cluster %d", m.cfg.PlaceQuery, m.cfg.Radius, c+1)
+		}
+	}
+	if err := m.entityWriter.Flush(m.ctx); err != nil {
+		return err
+	}
+	if len(suggestions) == 0 {
+		return fmt.Errorf("no %v found near any cluster", m.cfg.PlaceQuery)
+	}
+
+	// route everybody to the sites under their stored names, see site
+	m.officeSlice = make([]Office, len(suggestions))
+	for j, s := range suggestions {
+		m.officeSlice[j] = s.Office
+		m.officeSlice[j].Name = site_prefix + normalizeAddress(s.Office.Address)
+	}
+	m.logFields.setStage(stage_route)
+	if err := m.getAllDuration(); err != nil {
+		return err
+	}
+	for j, s := range suggestions {
+		m.officeSlice[j].Name = s.Office.Name
+	}
+	costs, err := m.buildCosts()
+	if err != nil {
+		return err
+	}
+	return m.writeSuggestions(costs, clusters, all, suggestions)
+}
+
+// minutesStats returns the mean and longest commute in minutes of persons
+// to office j, and how many of them have one.
+func minutesStats(costs *Costs, persons []int, j int) (float64, int, int) {
+	sum, max, n := 0, 0, 0
+	for _, i := range persons {
+		if s := costs.Seconds[i][j]; s != no_route {
+			sum += s / 60
+			n++
+			if s/60 > max {
+				max = s / 60
+			}
+		}
+	}
+	if n == 0 {
+		return 0, 0, 0
+	}
+	return float64(sum) / float64(n), max, n
+}
+
+func (m *Map) writeSuggestions(costs *Costs, clusters []Cluster, all Poi, suggestions []suggestion) error {
+	f := excelize.NewFile()
+	f.SetSheetName("Sheet1", sheet_candidates)
+	f.NewSheet(sheet_clusters)
+
+	header := []interface{}{"cluster", "persons", "median lat", "median lng", "centre lat", "centre lng"}
+	f.SetSheetRow(sheet_clusters, "A1", &header)
+	for c, cluster := range clusters {
+		row := []interface{}{c + 1, len(cluster.Persons), cluster.Median.Lat, cluster.Median.Lng, cluster.Centre.Lat, cluster.Centre.Lng}
+		f.SetSheetRow(sheet_clusters, "A"+strconv.Itoa(c+2), &row)
+	}
+	row := []interface{}{"all", len(m.personSlice), all.Lat, all.Lng, "", ""}
+	f.SetSheetRow(sheet_clusters, "A"+strconv.Itoa(len(clusters)+2), &row)
+
+	everybody := make([]int, len(m.personSlice))
+	for i := range everybody {
+		everybody[i] = i
+	}
+	// name, address and capacity first, as read by the sites command
+	header = []interface{}{"name", "address", "capacity", "cluster", "lat", "lng", "km from median",
+		"cluster mean", "cluster max", "mean", "max", "within 30", "within 45", "within 60"}
+	f.SetSheetRow(sheet_candidates, "A1", &header)
+	fmt.Fprintf(os.Stdout, "%-24v %7v %8v %8v %8v %8v\n", "site", "cluster", "km", "cluster", "mean", "<=45")
+	for j, s := range suggestions {
+		clusterMean, clusterMax, _ := minutesStats(costs, clusters[s.Cluster].Persons, j)
+		mean, max, _ := minutesStats(costs, everybody, j)
+		within := map[int]int{}
+		for i := range m.personSlice {
+			for _, t := range []int{30, 45, 60} {
+				if sec := costs.Seconds[i][j]; sec != no_route && sec/60 <= t {
+					within[t]++
+				}
+			}
+		}
+		o := s.Office
+		row := []interface{}{o.Name, o.Address, 0, s.Cluster + 1, o.Poi.Lat, o.Poi.Lng, s.Km,
+			clusterMean, clusterMax, mean, max, within[30], within[45], within[60]}
+		f.SetSheetRow(sheet_candidates, "A"+strconv.Itoa(j+2), &row)
+		fmt.Fprintf(os.Stdout, "%-24v %7d %8.1f %8.1f %8.1f %8d\n", o.Name, s.Cluster+1, s.Km, clusterMean, mean, within[45])
+	}
+	file := strings.TrimSuffix(m.cfg.ExcelFile, filepath.Ext(m.cfg.ExcelFile)) + ".suggest" + filepath.Ext(m.cfg.ExcelFile)
+	m.log.Infof("Write suggested sites to %v", file)
+	return f.SaveAs(file)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWeightedPois(t *testing.T) {
+	a, b := Poi{Lat: 31.2, Lng: 121.4}, Poi{Lat: 31.3, Lng: 121.5}
+	points, members := weightedPois([]Person{{Poi: a}, {Poi: b}, {}, {Poi: a}})
+	want := []weightedPoi{{Poi: a, Weight: 2}, {Poi: b, Weight: 1}}
+	if !reflect.DeepEqual(points, want) || !reflect.DeepEqual(members, [][]int{{0, 3}, {1}}) {
+		t.Errorf("weightedPois() = %v, %v, want %v, [[0 3] [1]]", points, members, want)
+	}
+}
+
+func TestGeometricMedian(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []weightedPoi
+		want   Poi
+	}{
+		{"one point", []weightedPoi{{Poi{Lat: 31.2, Lng: 121.4}, 1}}, Poi{Lat: 31.2, Lng: 121.4}},
+		{"middle of three", []weightedPoi{
+			{Poi{Lat: 31.2, Lng: 121.40}, 1},
+			{Poi{Lat: 31.2, Lng: 121.45}, 1},
+			{Poi{Lat: 31.2, Lng: 121.60}, 1},
+		}, Poi{Lat: 31.2, Lng: 121.45}},
+		{"heaviest point", []weightedPoi{
+			{Poi{Lat: 31.2, Lng: 121.4}, 3},
+			{Poi{Lat: 31.2, Lng: 121.5}, 1},
+			{Poi{Lat: 31.3, Lng: 121.4}, 1},
+		}, Poi{Lat: 31.2, Lng: 121.4}},
+		{"none", nil, Poi{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := geometricMedian(tt.points)
+			if km := distanceKm(got, tt.want); km > 0.05 {
+				t.Errorf("geometricMedian() = %v, %.3f km from %v", got, km, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterPois(t *testing.T) {
+	points := []weightedPoi{
+		{Poi{Lat: 31.20, Lng: 121.40}, 1},
+		{Poi{Lat: 31.21, Lng: 121.41}, 2},
+		{Poi{Lat: 31.20, Lng: 121.42}, 1},
+		{Poi{Lat: 31.50, Lng: 121.80}, 1},
+		{Poi{Lat: 31.51, Lng: 121.81}, 1},
+	}
+	tests := []struct {
+		name    string
+		points  []weightedPoi
+		k       int
+		medoids bool
+		want    int // clusters
+	}{
+		{"kmeans", points, 2, false, 2},
+		{"kmedoids", points, 2, true, 2},
+		{"one cluster", points, 1, true, 1},
+		{"more clusters than points", points[3:], 3, true, 2},
+		{"same points", []weightedPoi{points[0], points[0], points[3]}, 3, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			centres, labels := clusterPois(tt.points, tt.k, tt.medoids)
+			if len(centres) != tt.want || len(labels) != len(tt.points) {
+				t.Fatalf("clusterPois() = %v, %v, want %d clusters", centres, labels, tt.want)
+			}
+			for a := range centres {
+				for b := a + 1; b < len(centres); b++ {
+					if centres[a] == centres[b] {
+						t.Errorf("centres %d and %d are both at %v", a, b, centres[a])
+					}
+				}
+			}
+			if nearest := nearestCentres(tt.points, centres); !reflect.DeepEqual(labels, nearest) {
+				t.Errorf("labels %v, want the nearest centres %v", labels, nearest)
+			}
+			if !tt.medoids {
+				return
+			}
+			for _, c := range centres {
+				found := false
+				for _, p := range tt.points {
+					found = found || p.Poi == c
+				}
+				if !found {
+					t.Errorf("medoid %v is not one of the points", c)
+				}
+			}
+		})
+	}
+	for _, medoids := range []bool{false, true} {
+		_, labels := clusterPois(points, 2, medoids)
+		if want := []int{labels[0], labels[0], labels[0], labels[3], labels[3]}; labels[0] == labels[3] || !reflect.DeepEqual(labels, want) {
+			t.Errorf("clusterPois() with medoids %v = %v, want the near points together", medoids, labels)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+// Dashboard of the serve command: plots the persons and offices of a run on
+// a Baidu map. Colours follow the legend in index.html.
+(function () {
+  var map = null;
+  var run = "";
+  // the token of the server, given to the page as ?token=
+  var token = new URLSearchParams(window.location.search).get("token") || "";
+
+  function api(path) {
+    if (!token) return fetch(path);
+    return fetch(path + (path.indexOf("?") < 0 ? "?" : "&") + "token=" + encodeURIComponent(token));
+  }
+
+  function colour(minutes) {
+    if (minutes < 0) return "#999999";
+    if (minutes < 30) return "#2e9e44";
+    if (minutes < 45) return "#e6c229";
+    if (minutes < 60) return "#f17105";
+    return "#d11149";
+  }
+
+  function get(path) {
+    var sep = path.indexOf("?") < 0 ? "?" : "&";
+    return api(path + (run ? sep + "run=" + run : "")).then(function (resp) {
+      return resp.json().then(function (body) {
+        if (!resp.ok) throw new Error(body.error || resp.statusText);
+        return body;
+      });
+    });
+  }
+
+  function escape(s) {
+    var div = document.createElement("div");
+    div.textContent = s;
+    return div.innerHTML;
+  }
+
+  function showDetail(kind, id) {
+    get("api/" + kind + "?id=" + encodeURIComponent(id)).then(function (d) {
+      var html = "<h2>" + escape(d.name) + "</h2><p class=\"muted\">" + escape(d.address) + "</p><table>";
+      if (kind === "person") {
+        html += "<tr><th>#</th><th>Office</th><th>Min</th><th>Per mode</th></tr>";
+      } else {
+        html += "<tr><th>#</th><th>Person</th><th>Min</th><th>Mode</th></tr>";
+      }
+      d.ranking.forEach(function (r, i) {
+        var extra = escape(r.mode);
+        if (r.modes) {
+          extra = Object.keys(r.modes).sort().map(function (m) { return escape(m) + " " + r.modes[m]; }).join(", ");
+        }
+        html += "<tr><td>" + (i + 1) + "</td><td>" + escape(r.name) + "</td><td style=\"color:" + colour(r.minutes) + "\">" +
+          r.minutes + "</td><td>" + extra + "</td></tr>";
+      });
+      document.getElementById("detail").innerHTML = html + "</table>";
+    }).catch(function (err) {
+      document.getElementById("detail").textContent = err.message;
+    });
+  }
+
+  function marker(poi, shape, scale, minutes, title, onClick) {
+    var m = new BMap.Marker(new BMap.Point(poi.lng, poi.lat), {
+      icon: new BMap.Symbol(shape, {
+        scale: scale,
+        fillColor: colour(minutes),
+        fillOpacity: 0.9,
+        strokeColor: "#ffffff",
+        strokeWeight: 1
+      }),
+      title: title
+    });
+    m.addEventListener("click", onClick);
+    map.addOverlay(m);
+    return m.getPosition();
+  }
+
+  function draw() {
+    map.clearOverlays();
+    document.getElementById("detail").innerHTML = "";
+    get("api/map").then(function (data) {
+      var points = [];
+      data.persons.forEach(function (p) {
+        if (!p.poi.lat && !p.poi.lng) return;
+        points.push(marker(p.poi, BMap_Symbol_SHAPE_CIRCLE, 5, p.minutes, p.name + " → " + p.office + " (" + p.minutes + ")", function () {
+          showDetail("person", p.id);
+        }));
+      });
+      data.offices.forEach(function (o) {
+        if (!o.poi.lat && !o.poi.lng) return;
+        points.push(marker(o.poi, BMap_Symbol_SHAPE_POINT, 1.2, o.median, o.name, function () {
+          showDetail("office", o.id);
+        }));
+      });
+      if (points.length) map.setViewport(points);
+    }).catch(function (err) {
+      document.getElementById("detail").textContent = err.message;
+    });
+  }
+
+  window.initMap = function () {
+    map = new BMap.Map("map");
+    map.centerAndZoom("上海", 11);
+    map.enableScrollWheelZoom(true);
+    map.addControl(new BMap.NavigationControl());
+    api("api/runs").then(function (resp) { return resp.json(); }).then(function (runs) {
+      var select = document.getElementById("runs");
+      (runs || []).forEach(function (r) {
+        var option = document.createElement("option");
+        option.value = r.id;
+        option.textContent = r.started_at + " " + r.workbook;
+        select.appendChild(option);
+      });
+      select.addEventListener("change", function () {
+        run = select.value;
+        draw();
+      });
+      run = select.value;
+      draw();
+    });
+  };
+
+  api("api/config").then(function (resp) { return resp.json(); }).then(function (cfg) {
+    if (!cfg.map_ak) {
+      document.getElementById("map").textContent = "Start the server with -map-ak, a browser key of the Baidu map javascript api.";
+      return;
+    }
+    var script = document.createElement("script");
+    script.src = "https://api.map.baidu.com/api?v=3.0&ak=" + encodeURIComponent(cfg.map_ak) + "&callback=initMap";
+    document.body.appendChild(script);
+  });
+})();
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// claimBatch leases up to size runnable jobs matching filter to this
+// process. Every job is claimed with its own find-and-modify, so concurrent
+// workers never get the same job.
+func (m *Map) claimBatch(filter bson.M, size int) ([]Job, error) {
+	r := []Job{}
+	for len(r) < size {
+		now := time.Now()
+		f := m.runnableFilter(now)
+		for k, v := range filter {
+			f[k] = v
+		}
+		change := qmgo.Change{
+			Update: bson.M{"$set": bson.M{
+				"state":       job_in_flight,
+				"owner":       m.owner,
+				"lease_until": now.Add(m.cfg.Lease),
+				"updated_at":  now,
+			}},
+			ReturnNew: true,
+		}
+		job := Job{}
+		err := m.jobs().Find(m.ctx, f).Apply(change, &job)
+		if err == qmgo.ErrNoSuchDocuments {
+			break
+		}
+		if err != nil {
+			return r, err
+		}
+		r = append(r, job)
+	}
+	return r, nil
+}
+
+// resolveJobs loads the persons and offices of the claimed jobs from the
+// store, so a worker does not need the workbook.
+func (m *Map) resolveJobs(jobs []Job) ([]RouteJob, error) {
+	ids := make([]primitive.ObjectID, 0, 2*len(jobs))
+	for _, j := range jobs {
+		ids = append(ids, j.PersonId, j.OfficeId)
+	}
+	entities := []Person{}
+	if err := m.mongoCli.Find(m.ctx, bson.M{"_id": bson.M{"$in": ids}}).All(&entities); err != nil {
+		return nil, err
+	}
+	personMap := make(map[primitive.ObjectID]*Person, len(entities))
+	officeMap := make(map[primitive.ObjectID]*Office, len(entities))
+	for i, e := range entities {
+		personMap[e.Id] = &entities[i]
+		officeMap[e.Id] = &Office{Id: e.Id, Name: e.Name, Address: e.Address, Poi: e.Poi}
+	}
+	r := make([]RouteJob, 0, len(jobs))
+	for _, j := range jobs {
+		departAt := j.DepartAt
+		if departAt == "" {
+			departAt = m.cfg.DepartAt
+		}
+		r = append(r, RouteJob{Id: j.Id, PersonId: j.PersonId, OfficeId: j.OfficeId, Person: personMap[j.PersonId], Office: officeMap[j.OfficeId], Mode: j.Mode, DepartAt: departAt, Attempts: j.Attempts, LeaseUntil: j.LeaseUntil})
+	}
+	return r, nil
+}
+
+// routeBatch routes the jobs through the worker pool and commits the results
+// to the ledger. Once interrupted, the jobs that were not started are
+// released.
+func (m *Map) routeBatch(jobs []RouteJob) error {
+	ctx, cancel := context.WithCancel(m.interrupted)
+	defer cancel()
+	tasks := make(chan Task)
+	results := make(chan RouteResult, m.cfg.Workers)
+	aggregated := make(chan error, 1)
+	produced := make(chan struct{})
+	go func() {
+		aggregated <- m.aggregateRoutes(results, cancel)
+	}()
+	go func() {
+		defer close(produced)
+		defer close(tasks)
+		for i, job := range jobs {
+			job := job
+			if job.Person == nil || job.Office == nil {
+				results <- RouteResult{Job: job, Err: fmt.Errorf("Person or office of job %v does not exist", job.Id.Hex())}
+				continue
+			}
+			if isZeroPoi(job.Person.Poi) || isZeroPoi(job.Office.Poi) {
+				results <- RouteResult{Job: job, Err: fmt.Errorf("No poi for %v or %v", job.Person.Name, job.Office.Name)}
+				continue
+			}
+			task := func(ctx context.Context) {
+				route, err := m.calRouteAt(ctx, job.Person.Poi, job.Office.Poi, job.Mode, job.DepartAt)
+				results <- RouteResult{Job: job, Route: route, Err: err}
+			}
+			select {
+			case tasks <- task:
+			case <-ctx.Done():
+				for _, job := range jobs[i:] {
+					results <- RouteResult{Job: job, Err: errInterrupted}
+				}
+				return
+			}
+		}
+	}()
+	newPool(m.cfg.Workers, m.limiter).Run(ctx, m.calls, tasks)
+	<-produced
+	close(results)
+	if err := <-aggregated; err != nil {
+		return err
+	}
+	if err := m.interruptErr(); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("Routing is interrupted")
+	}
+	return nil
+}
+
+// work claims and routes batches of jobs matching filter until none is left
+// to claim, and returns how many jobs it routed.
+func (m *Map) work(filter bson.M) (int, error) {
+	n := 0
+	for {
+		if err := m.interruptErr(); err != nil {
+			return n, err
+		}
+		claimed, err := m.claimBatch(filter, m.cfg.Batch)
+		if err != nil {
+			return n, err
+		}
+		if len(claimed) == 0 {
+			return n, nil
+		}
+		m.log.Infof("Claimed %d routes", len(claimed))
+		jobs, err := m.resolveJobs(claimed)
+		if err != nil {
+			return n, err
+		}
+		if err := m.routeBatch(jobs); err != nil {
+			return n, err
+		}
+		n += len(jobs)
+	}
+}
+
+// unfinishedFilter matches the jobs that still have to be routed: everything
+// but done jobs and failed jobs without attempts left.
+func (m *Map) unfinishedFilter() bson.M {
+	return bson.M{"$nor": []bson.M{
+		{"state": job_done},
+		{"state": job_failed, "attempts": bson.M{"$gte": m.cfg.MaxAttempts}},
+	}}
+}
+
+// unfinishedByMode counts the unfinished jobs matching filter per mode.
+func (m *Map) unfinishedByMode(filter bson.M) (map[string]int, error) {
+	r := map[string]int{}
+	for _, mode := range m.cfg.Modes {
+		f := m.unfinishedFilter()
+		for k, v := range filter {
+			f[k] = v
+		}
+		f["mode"] = mode
+		n, err := m.jobs().Find(m.ctx, f).Count()
+		if err != nil {
+			return r, err
+		}
+		r[mode] = int(n)
+	}
+	return r, nil
+}
+
+// waitForJobs routes jobs matching filter itself when local routing is on,
+// and waits until workers finished the others. Leases of crashed workers
+// expire and their jobs are claimed again.
+func (m *Map) waitForJobs(filter bson.M) error {
+	for {
+		if m.localRouting {
+			if _, err := m.work(filter); err != nil {
+				return err
+			}
+		}
+		f := m.unfinishedFilter()
+		for k, v := range filter {
+			f[k] = v
+		}
+		left, err := m.jobs().Find(m.ctx, f).Count()
+		if err != nil {
+			return err
+		}
+		if left == 0 {
+			return nil
+		}
+		m.log.Infof("Waiting for %d routes of other workers", left)
+		select {
+		case <-m.interrupted.Done():
+			return errInterrupted
+		case <-time.After(m.cfg.Poll):
+		}
+	}
+}
+
+// runWorker routes jobs of any coordinator until it has been idle for
+// m.cfg.Idle. The mode and the departure time come from the jobs, not from
+// the flags of the worker.
+func (m *Map) runWorker() error {
+	if err := m.ensureJobIndexes(); err != nil {
+		m.log.Errorf("Creating job indexes fails, err: %v", err)
+	}
+	m.logFields.setStage(stage_route)
+	m.log.Infof("Worker %v starts", m.owner)
+	m.progress.Start(stage_route, nil)
+	defer func() {
+		printSummary(os.Stdout, m.progress.Summary())
+	}()
+	idleSince := time.Now()
+	for {
+		n, err := m.work(bson.M{})
+		if err == errInterrupted {
+			m.log.Infof("Worker %v is interrupted, exit", m.owner)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			idleSince = time.Now()
+		} else if time.Since(idleSince) > m.cfg.Idle {
+			m.log.Infof("Worker %v has been idle for %v, exit", m.owner, m.cfg.Idle)
+			return nil
+		}
+		select {
+		case <-m.interrupted.Done():
+			m.log.Infof("Worker %v is interrupted, exit", m.owner)
+			return nil
+		case <-time.After(m.cfg.Poll):
+		}
+	}
+}
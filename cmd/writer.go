@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/qiniu/qmgo"
+	"github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// BulkWriter buffers updates of one collection and sends them as BulkWrite
+// batches. It is safe for concurrent use. Once a batch fails after all
+// retries, the error is kept and returned by every later call so the stage
+// that owns the writer can fail.
+type BulkWriter struct {
+	coll      *mongo.Collection
+	name      string
+	log       *logrus.Logger
+	batchSize int
+	retries   int
+	ordered   bool
+	lock      sync.Mutex
+	models    []mongo.WriteModel
+	err       error
+}
+
+func newBulkWriter(coll *qmgo.Collection, cfg *Config, log *logrus.Logger) *BulkWriter {
+	w := &BulkWriter{
+		name:      coll.GetCollectionName(),
+		log:       log,
+		batchSize: cfg.BulkSize,
+		retries:   cfg.WriteRetries,
+		ordered:   cfg.BulkOrdered,
+	}
+	w.coll, w.err = coll.CloneCollection()
+	return w
+}
+
+// UpsertId queues a replacement of the document with the given id.
+func (w *BulkWriter) UpsertId(ctx context.Context, id interface{}, doc interface{}) error {
+	return w.Upsert(ctx, bson.M{"_id": id}, doc)
+}
+
+// Upsert queues a replacement of the document matching filter.
+func (w *BulkWriter) Upsert(ctx context.Context, filter interface{}, doc interface{}) error {
+	return w.queue(ctx, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(doc).SetUpsert(true))
+}
+
+// UpdateOne queues an update of the document matching filter.
+func (w *BulkWriter) UpdateOne(ctx context.Context, filter interface{}, update interface{}, upsert bool) error {
+	return w.queue(ctx, mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(upsert))
+}
+
+func (w *BulkWriter) queue(ctx context.Context, model mongo.WriteModel) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.models = append(w.models, model)
+	if len(w.models) < w.batchSize {
+		return nil
+	}
+	return w.run(ctx)
+}
+
+// Flush sends every queued update.
+func (w *BulkWriter) Flush(ctx context.Context) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.run(ctx)
+}
+
+// run must be called with the lock held. A failed batch is sent again as a
+// whole, so every queued write must be idempotent: replacements, and
+// updates that only $set or $setOnInsert, never $inc or $push.
+func (w *BulkWriter) run(ctx context.Context) error {
+	if len(w.models) == 0 {
+		return nil
+	}
+	var err error
+	for i := 0; i <= w.retries; i++ {
+		if i > 0 {
+			metrics.retries.Add(1, w.name)
+			w.log.Warnf("Retry bulk write of %d updates to %v (%d/%d), err: %v", len(w.models), w.name, i, w.retries, err)
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		_, err = w.coll.BulkWrite(ctx, w.models, options.BulkWrite().SetOrdered(w.ordered))
+		if err == nil {
+			w.models = nil
+			return nil
+		}
+		if !isTransient(err) {
+			break
+		}
+	}
+	metrics.writeErrors.Add(1, w.name)
+	w.err = fmt.Errorf("Bulk write of %d updates to %v fails, err: %v", len(w.models), w.name, err)
+	return w.err
+}
+
+func isTransient(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	if se, ok := err.(mongo.ServerError); ok {
+		return se.HasErrorLabel("RetryableWriteError") || se.HasErrorLabel("TransientTransactionError")
+	}
+	return false
+}
+
+// flushWriters sends whatever is left in the writers, used on shutdown.
+func (m *Map) flushWriters() error {
+	var r error
+	for _, w := range []*BulkWriter{m.entityWriter, m.durationWriter, m.geocodeWriter, m.jobWriter} {
+		if w == nil {
+			continue
+		}
+		if err := w.Flush(m.ctx); err != nil {
+			m.log.Errorf("Flushing writer fails, err: %v", err)
+			r = err
+		}
+	}
+	return r
+}